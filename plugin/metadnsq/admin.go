@@ -0,0 +1,350 @@
+package metadnsq
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// Admin HTTP API serves upstream and matcher state of a server block as JSON
+//	GET  /upstreams                    state of every upstream
+//	POST /check?host=<name>&tag=<tag>   force health check on matched hosts
+//	POST /drain?host=<name>&tag=<tag>   drain matched hosts for maintenance
+//	POST /undrain?host=<name>&tag=<tag> re-enable matched hosts
+// Mutating endpoints require host and/or tag, or all=true to select every host
+// Drain state lives in memory only, hosts are re-enabled once the Corefile is reloaded
+// The API listens on loopback addresses unless a token is given, which is then required by every request:
+//	admin_listen <addr:port> [token]
+//	Authorization: Bearer <token>
+type adminServer struct {
+	sync.Mutex
+	addr      string
+	token     string
+	upstreams []*reloadableUpstream
+	srv       *http.Server
+}
+
+// Return nil if none of the upstreams has admin_listen
+func newAdminServer(ups []Upstream) (*adminServer, error) {
+	var admin *adminServer
+	for _, up := range ups {
+		u := up.(*reloadableUpstream)
+		if u.adminListen == "" {
+			continue
+		}
+		if admin != nil && (admin.addr != u.adminListen || admin.token != u.adminToken) {
+			return nil, fmt.Errorf("conflict admin_listen %q and %q in the same server", admin.addr, u.adminListen)
+		}
+		admin = &adminServer{addr: u.adminListen, token: u.adminToken}
+	}
+	if admin == nil {
+		return nil, nil
+	}
+	for _, up := range ups {
+		admin.upstreams = append(admin.upstreams, up.(*reloadableUpstream))
+	}
+	return admin, nil
+}
+
+func (a *adminServer) Start() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.srv != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", a.handleUpstreams)
+	mux.HandleFunc("/check", a.handleCheck)
+	mux.HandleFunc("/drain", a.handleDrain(true))
+	mux.HandleFunc("/undrain", a.handleDrain(false))
+	a.srv = &http.Server{Handler: a.authorize(mux), ReadTimeout: defaultAdminTimeout, WriteTimeout: defaultAdminTimeout}
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin: %v", err)
+		}
+	}(a.srv)
+	log.Infof("admin: listening on %v", a.addr)
+	return nil
+}
+
+// Reject requests without the admin token, if any
+func (a *adminServer) authorize(next http.Handler) http.Handler {
+	if a.token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminServer) Stop() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAdminTimeout)
+	defer cancel()
+	err := a.srv.Shutdown(ctx)
+	a.srv = nil
+	return err
+}
+
+type adminHost struct {
+	Name        string         `json:"name"`
+	Tag         string         `json:"tag"`
+	Proto       string         `json:"proto"`
+	Fails       int32          `json:"fails"`
+	Down        bool           `json:"down"`
+	Ejected     bool           `json:"ejected"`
+	Drained     bool           `json:"drained"`
+	Poisoned    bool           `json:"poisoned"`
+	Inflight    int32          `json:"inflight"`
+	AvgDialTime string         `json:"avg_dial_time"`
+	Conns       map[string]int `json:"conns"`
+}
+
+type adminMatcher struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Data  string `json:"data"`
+}
+
+type adminUpstream struct {
+	Index    int            `json:"index"`
+	MatchAny bool           `json:"match_any"`
+	Tags     []string       `json:"tags"`
+	NonTags  []string       `json:"non_tags"`
+	Inline   []string       `json:"inline"`
+	Except   []string       `json:"except"`
+	Policy   string         `json:"policy"`
+	Spray    bool           `json:"spray"`
+	Matchers []adminMatcher `json:"matchers"`
+	Hosts    []adminHost    `json:"hosts"`
+}
+
+func newAdminHost(uh *UpstreamHost) adminHost {
+	conns := make(map[string]int)
+	if uh.transport != nil {
+		n := uh.transport.ConnCount()
+		conns["udp"] = n[typeUdp]
+		conns["tcp"] = n[typeTcp]
+		conns["tls"] = n[typeTls]
+	}
+	h := adminHost{
+		Name:     uh.Name(),
+		Tag:      uh.tag,
+		Proto:    uh.proto,
+		Fails:    atomic.LoadInt32(&uh.fails),
+		Down:     uh.Down(),
+		Ejected:  uh.Ejected(),
+		Drained:  uh.Drained(),
+		Poisoned: uh.Poisoned(),
+		Inflight: uh.Inflight(),
+		Conns:    conns,
+	}
+	if uh.transport != nil {
+		h.AvgDialTime = uh.transport.AvgDialTime().String()
+	}
+	return h
+}
+
+func domainSetSlice(d domainSet) []string {
+	names := make([]string, 0, d.Len())
+	_ = d.ForEachDomain(func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+func newAdminUpstream(i int, u *reloadableUpstream) adminUpstream {
+	au := adminUpstream{
+		Index:    i,
+		MatchAny: u.matchAny,
+		Tags:     u.matchGeositeTags,
+		NonTags:  u.nonMatchGeositeTags,
+		Inline:   domainSetSlice(u.inline),
+		Except:   domainSetSlice(u.ignored),
+		Policy:   "random",
+		Spray:    u.spray != nil,
+		Matchers: make([]adminMatcher, 0),
+		Hosts:    make([]adminHost, 0, len(u.hosts)),
+	}
+	if u.policy != nil {
+		au.Policy = fmt.Sprint(u.policy)
+	}
+	u.subMatchers.RLock()
+	for j, m := range u.subMatchers.matchers {
+		au.Matchers = append(au.Matchers, adminMatcher{Index: j, Name: m.name, Data: m.String()})
+	}
+	u.subMatchers.RUnlock()
+	for _, uh := range u.hosts {
+		au.Hosts = append(au.Hosts, newAdminHost(uh))
+	}
+	return au
+}
+
+func (a *adminServer) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ups := make([]adminUpstream, 0, len(a.upstreams))
+	for i, u := range a.upstreams {
+		ups = append(ups, newAdminUpstream(i, u))
+	}
+	writeJson(w, ups)
+}
+
+type adminCheckResult struct {
+	Host  string `json:"host"`
+	Tag   string `json:"tag"`
+	Error string `json:"error,omitempty"`
+	Down  bool   `json:"down"`
+}
+
+func (a *adminServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hosts, err := a.selectHosts(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(hosts) == 0 {
+		http.Error(w, "no such host", http.StatusNotFound)
+		return
+	}
+
+	results := make([]adminCheckResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, uh := range hosts {
+		wg.Add(1)
+		go func(i int, uh *UpstreamHost) {
+			defer wg.Done()
+			res := adminCheckResult{Host: uh.Name(), Tag: uh.tag}
+			if err := uh.Check(); err != nil {
+				res.Error = err.Error()
+			}
+			res.Down = uh.Down()
+			results[i] = res
+		}(i, uh)
+	}
+	wg.Wait()
+	writeJson(w, results)
+}
+
+type adminDrainResult struct {
+	Hosts []adminHost `json:"hosts"`
+	Note  string      `json:"note"`
+}
+
+func (a *adminServer) handleDrain(drained bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		hosts, err := a.selectHosts(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(hosts) == 0 {
+			http.Error(w, "no such host", http.StatusNotFound)
+			return
+		}
+		res := adminDrainResult{Hosts: make([]adminHost, 0, len(hosts)), Note: drainNote}
+		for _, uh := range hosts {
+			uh.SetDrained(drained)
+			res.Hosts = append(res.Hosts, newAdminHost(uh))
+		}
+		writeJson(w, res)
+	}
+}
+
+// Select hosts by host and tag query parameters, every host only if all=true is given explicitly
+func (a *adminServer) selectHosts(r *http.Request) ([]*UpstreamHost, error) {
+	query := r.URL.Query()
+	name, tag, all := query.Get("host"), query.Get("tag"), query.Get("all")
+	switch {
+	case all != "" && all != "true":
+		return nil, fmt.Errorf("invalid all %q", all)
+	case all == "true" && (name != "" || tag != ""):
+		return nil, errors.New("all=true can't be combined with host or tag")
+	case all == "" && name == "" && tag == "":
+		return nil, errors.New("host, tag or all=true is required")
+	}
+
+	var hosts []*UpstreamHost
+	for _, u := range a.upstreams {
+		for _, uh := range u.hosts {
+			if name != "" && uh.Name() != name {
+				continue
+			}
+			if tag != "" && uh.tag != tag {
+				continue
+			}
+			hosts = append(hosts, uh)
+		}
+	}
+	return hosts, nil
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", mimeTypeJson)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Warningf("admin: %v", err)
+	}
+}
+
+func parseAdminListen(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 && len(args) != 2 {
+		return c.ArgErr()
+	}
+	host, _, err := net.SplitHostPort(args[0])
+	if err != nil {
+		return c.Errf("%v: %v", dir, err)
+	}
+	if len(args) == 2 {
+		u.adminToken = args[1]
+	} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return c.Errf("%v: %q isn't a loopback address, a token is required", dir, args[0])
+	}
+	u.adminListen = args[0]
+	log.Infof("%v: %v token: %v", dir, u.adminListen, u.adminToken != "")
+	return nil
+}
+
+// Forced health checks may take a while
+const defaultAdminTimeout = 30 * time.Second
+
+const drainNote = "drain state is kept in memory only, it's reset once the Corefile is reloaded"
@@ -0,0 +1,111 @@
+package metadnsq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func TestAdminUpstreams(t *testing.T) {
+	c := caddy.NewTestController("dns", `metadnsq . {
+		admin_listen 127.0.0.1:9801
+		to t1 1.2.3.4 tls://1.1.1.1@cloudflare-dns.com
+		policy least_outstanding
+		matcher {
+			name office
+			client_ips wjtoffice
+			to t1
+		}
+	}`)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := newAdminServer(ups)
+	if err != nil || admin == nil {
+		t.Fatalf("newAdminServer() failed: %v %v", admin, err)
+	}
+
+	w := httptest.NewRecorder()
+	admin.handleUpstreams(w, httptest.NewRequest(http.MethodGet, "/upstreams", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, got %v", http.StatusOK, w.Code)
+	}
+	var res []adminUpstream
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || len(res[0].Hosts) != 2 || len(res[0].Matchers) != 1 {
+		t.Fatalf("Unexpected response %+v", res)
+	}
+	if res[0].Policy != "least_outstanding" || res[0].Matchers[0].Name != "office" || res[0].Hosts[1].Proto != "tls" {
+		t.Errorf("Unexpected response %+v", res)
+	}
+
+	w = httptest.NewRecorder()
+	admin.handleCheck(w, httptest.NewRequest(http.MethodPost, "/check?tag=t2", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v, got %v", http.StatusNotFound, w.Code)
+	}
+
+	// Mutating endpoints never select every host implicitly
+	for _, target := range []string{"/check", "/drain", "/undrain?all=1", "/drain?all=true&tag=t1"} {
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		if target == "/check" {
+			admin.handleCheck(w, r)
+		} else {
+			admin.handleDrain(true)(w, r)
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected status %v, got %v", target, http.StatusBadRequest, w.Code)
+		}
+	}
+	for _, uh := range ups[0].(*reloadableUpstream).hosts {
+		if uh.Drained() {
+			t.Errorf("%v shouldn't be drained", uh.Name())
+		}
+	}
+}
+
+func TestAdminAuthorize(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	admin := &adminServer{token: "secret"}
+	for _, test := range []struct {
+		auth     string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer foo", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/upstreams", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		admin.authorize(ok).ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("Authorization %q: expected status %v, got %v", test.auth, test.expected, w.Code)
+		}
+	}
+}
+
+func TestSetupAdminListen(t *testing.T) {
+	tests := []testCase{
+		// Negative
+		{"metadnsq . { to t1 1.2.3.4 \n admin_listen 9801 \n }", true, "missing port"},
+		{"metadnsq . { to t1 1.2.3.4 \n admin_listen :9801 \n }", true, "token is required"},
+		{"metadnsq . { to t1 1.2.3.4 \n admin_listen 10.0.0.1:9801 \n }", true, "token is required"},
+		// Positive
+		{"metadnsq . { to t1 1.2.3.4 \n admin_listen 127.0.0.1:9801 \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n admin_listen [::1]:9801 \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n admin_listen localhost:9801 \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n admin_listen :9801 secret \n }", false, ""},
+	}
+
+	runSetupTests(t, tests)
+}
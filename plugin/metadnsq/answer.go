@@ -0,0 +1,129 @@
+package metadnsq
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Static answers of a matcher, which synthesize a local response without contacting any upstream
+//	answer A <ipv4> | answer AAAA <ipv6> | answer CNAME <domain>
+//	answer_ttl <seconds>
+type staticAnswer struct {
+	ips   []net.IP
+	cname string // FQDN, exclusive with ips
+	ttl   uint32
+}
+
+func newStaticAnswer() *staticAnswer {
+	return &staticAnswer{ttl: defaultAnswerTtl}
+}
+
+func (a *staticAnswer) isEmpty() bool {
+	return a == nil || (len(a.ips) == 0 && a.cname == "")
+}
+
+func (a *staticAnswer) String() string {
+	if a.isEmpty() {
+		return ""
+	}
+	var strs []string
+	if a.cname != "" {
+		strs = append(strs, "CNAME:"+a.cname)
+	}
+	for _, ip := range a.ips {
+		strs = append(strs, ip.String())
+	}
+	return fmt.Sprintf("%v ttl:%v", strings.Join(strs, ","), a.ttl)
+}
+
+// Return answer records for the question, empty if no record of the query type is configured(i.e. NODATA)
+func (a *staticAnswer) records(q dns.Question) []dns.RR {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: a.ttl}
+	}
+	if a.cname != "" {
+		return []dns.RR{&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: a.cname}}
+	}
+	var rrs []dns.RR
+	for _, ip := range a.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.Qtype == dns.TypeA {
+				rrs = append(rrs, &dns.A{Hdr: hdr(dns.TypeA), A: ip4})
+			}
+		} else if q.Qtype == dns.TypeAAAA {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+// Synthesize a response to req
+func (a *staticAnswer) reply(req *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.RecursionAvailable = true
+	if len(req.Question) != 0 {
+		msg.Answer = a.records(req.Question[0])
+	}
+	if o := req.IsEdns0(); o != nil {
+		msg.SetEdns0(o.UDPSize(), o.Do())
+	}
+	return msg
+}
+
+// Replace answer and authority sections of an upstream reply, EDNS0 OPT is kept
+func (a *staticAnswer) rewrite(reply *dns.Msg) {
+	reply.Rcode = dns.RcodeSuccess
+	reply.Answer = nil
+	if len(reply.Question) != 0 {
+		reply.Answer = a.records(reply.Question[0])
+	}
+	reply.Ns = nil
+	keepOnlyOpt(reply)
+}
+
+func (a *staticAnswer) parse(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected <type> <value>, got %q", args)
+	}
+	switch t := strings.ToUpper(args[0]); t {
+	case "A", "AAAA":
+		ip := net.ParseIP(args[1])
+		if ip == nil || (t == "A") != (ip.To4() != nil) {
+			return fmt.Errorf("%q isn't an %v address", args[1], t)
+		}
+		if a.cname != "" {
+			return fmt.Errorf("%v is exclusive with CNAME", t)
+		}
+		a.ips = append(a.ips, ip)
+	case "CNAME":
+		if _, ok := dns.IsDomainName(args[1]); !ok {
+			return fmt.Errorf("%q isn't a valid domain name", args[1])
+		}
+		if len(a.ips) != 0 || a.cname != "" {
+			return fmt.Errorf("CNAME is exclusive with other answers")
+		}
+		a.cname = dns.Fqdn(strings.ToLower(args[1]))
+	default:
+		return fmt.Errorf("unsupported answer type %q", args[0])
+	}
+	return nil
+}
+
+func (a *staticAnswer) parseTtl(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected <seconds>, got %q", args)
+	}
+	ttl, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid ttl %q", args[0])
+	}
+	a.ttl = uint32(ttl)
+	return nil
+}
+
+const defaultAnswerTtl = 60
@@ -0,0 +1,63 @@
+package metadnsq
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticAnswer(t *testing.T) {
+	a := newStaticAnswer()
+	for _, args := range [][]string{{"A", "10.0.0.1"}, {"aaaa", "fd00::1"}} {
+		if err := a.parse(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.parseTtl([]string{"300"}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	msg := a.reply(req)
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 || msg.IsEdns0() == nil {
+		t.Fatalf("Unexpected reply %v", msg)
+	}
+	if rr, ok := msg.Answer[0].(*dns.A); !ok || rr.A.String() != "10.0.0.1" || rr.Hdr.Ttl != 300 || rr.Hdr.Name != "ads.example.com." {
+		t.Errorf("Unexpected answer %v", msg.Answer[0])
+	}
+
+	req.SetQuestion("ads.example.com.", dns.TypeMX)
+	if msg := a.reply(req); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 {
+		t.Errorf("Expected NODATA, got %v", msg)
+	}
+
+	reply := new(dns.Msg)
+	reply.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	reply.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("example.com. 60 IN SOA ns.example.com. root.example.com. 1 2 3 4 5")
+	reply.Ns = append(reply.Ns, soa)
+	a.rewrite(reply)
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 || len(reply.Ns) != 0 {
+		t.Errorf("Unexpected rewritten reply %v", reply)
+	}
+
+	cname := newStaticAnswer()
+	if err := cname.parse([]string{"CNAME", "Block.Example.NET"}); err != nil {
+		t.Fatal(err)
+	}
+	req.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	if msg := cname.reply(req); len(msg.Answer) != 1 || msg.Answer[0].(*dns.CNAME).Target != "block.example.net." {
+		t.Errorf("Unexpected CNAME reply %v", msg)
+	}
+
+	for _, args := range [][]string{{"A"}, {"A", "fd00::1"}, {"AAAA", "10.0.0.1"}, {"MX", "mail.example.com"}, {"CNAME", "a..b"}} {
+		if err := newStaticAnswer().parse(args); err == nil {
+			t.Errorf("%q: expected error", args)
+		}
+	}
+	if err := cname.parse([]string{"A", "10.0.0.1"}); err == nil {
+		t.Errorf("Expected CNAME to be exclusive")
+	}
+}
@@ -0,0 +1,151 @@
+package metadnsq
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Block response of a matcher, along with an RFC 8914 Extended DNS Error option if the client supports EDNS0
+//	block nxdomain|refused|noerror_empty|drop
+//	ede blocked|filtered|censored|none [extra text...]
+// The legacy nxdomain directive keeps answering a bare NXDOMAIN, SOA and EDE are only added if block or ede is configured
+type blockAction struct {
+	mode     string // Empty if not blocked
+	edeCode  uint16
+	noEde    bool
+	edeText  string // "blocked by matcher <name|index>" if empty
+	explicit bool   // Configured by block or ede rather than the legacy nxdomain
+}
+
+func newBlockAction() *blockAction {
+	return &blockAction{edeCode: dns.ExtendedErrorCodeBlocked}
+}
+
+func (b *blockAction) enabled() bool {
+	return b != nil && b.mode != ""
+}
+
+func (b *blockAction) String() string {
+	if !b.enabled() {
+		return ""
+	}
+	if b.noEde || !b.explicit {
+		return b.mode
+	}
+	return fmt.Sprintf("%v ede:%v %q", b.mode, dns.ExtendedErrorCodeToString[b.edeCode], b.edeText)
+}
+
+// Return the block response of req, nil if it should be dropped
+func (m *subMatcher) blockReply(req *dns.Msg) *dns.Msg {
+	b := m.block
+	if b.mode == blockModeDrop {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	if !b.explicit {
+		// Same as the error response written by CoreDNS for plugins returning NXDOMAIN
+		msg.SetRcode(req, dns.RcodeNameError)
+		if o := req.IsEdns0(); o != nil {
+			msg.SetEdns0(o.UDPSize(), o.Do())
+		}
+		return msg
+	}
+	msg.SetReply(req)
+	msg.RecursionAvailable = true
+	switch b.mode {
+	case blockModeNxdomain:
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = m.negativeSoa(req)
+	case blockModeRefused:
+		msg.Rcode = dns.RcodeRefused
+	case blockModeNoerrorEmpty:
+		msg.Ns = m.negativeSoa(req)
+	}
+
+	if o := req.IsEdns0(); o != nil {
+		msg.SetEdns0(o.UDPSize(), o.Do())
+		if !b.noEde {
+			text := b.edeText
+			if text == "" {
+				text = "blocked by matcher " + m.label()
+			}
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: b.edeCode, ExtraText: text})
+		}
+	}
+	return msg
+}
+
+// Synthesize SOA in authority section so that negative answers can be cached, TTL follows answer_ttl
+func (m *subMatcher) negativeSoa(req *dns.Msg) []dns.RR {
+	return negativeSoa(req, m.answer.ttl)
+}
+
+func negativeSoa(msg *dns.Msg, ttl uint32) []dns.RR {
+	if len(msg.Question) == 0 {
+		return nil
+	}
+	return []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + pluginName + ".",
+		Mbox:    "hostmaster." + pluginName + ".",
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}}
+}
+
+func (b *blockAction) parseMode(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one of %v, got %q", strings.Join(blockModes, "|"), args)
+	}
+	for _, mode := range blockModes {
+		if args[0] == mode {
+			b.mode = mode
+			b.explicit = true
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown block mode %q", args[0])
+}
+
+func (b *blockAction) parseEde(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected blocked|filtered|censored|none [extra text...]")
+	}
+	switch strings.ToLower(args[0]) {
+	case "blocked":
+		b.edeCode = dns.ExtendedErrorCodeBlocked
+	case "filtered":
+		b.edeCode = dns.ExtendedErrorCodeFiltered
+	case "censored":
+		b.edeCode = dns.ExtendedErrorCodeCensored
+	case "none":
+		if len(args) != 1 {
+			return fmt.Errorf("none takes no extra text")
+		}
+		b.noEde = true
+		b.explicit = true
+		return nil
+	default:
+		return fmt.Errorf("unknown extended error %q", args[0])
+	}
+	b.noEde = false
+	b.edeText = strings.Join(args[1:], " ")
+	b.explicit = true
+	return nil
+}
+
+const (
+	blockModeNxdomain     = "nxdomain"
+	blockModeRefused      = "refused"
+	blockModeNoerrorEmpty = "noerror_empty"
+	blockModeDrop         = "drop"
+)
+
+var blockModes = []string{blockModeNxdomain, blockModeRefused, blockModeNoerrorEmpty, blockModeDrop}
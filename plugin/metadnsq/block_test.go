@@ -0,0 +1,96 @@
+package metadnsq
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockReply(t *testing.T) {
+	m := newSubMatcher()
+	m.name = "ads"
+	if err := m.block.parseMode([]string{"noerror_empty"}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	msg := m.blockReply(req)
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 || len(msg.Ns) != 1 || msg.IsEdns0() != nil {
+		t.Fatalf("Unexpected reply %v", msg)
+	}
+	if soa, ok := msg.Ns[0].(*dns.SOA); !ok || soa.Hdr.Name != "ads.example.com." || soa.Minttl != defaultAnswerTtl {
+		t.Errorf("Unexpected SOA %v", msg.Ns[0])
+	}
+
+	req.SetEdns0(1232, false)
+	msg = m.blockReply(req)
+	ede := edeOption(msg)
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeBlocked || ede.ExtraText != "blocked by matcher ads" {
+		t.Errorf("Unexpected EDE %v", ede)
+	}
+
+	if err := m.block.parseEde([]string{"censored", "court", "order"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.block.parseMode([]string{"refused"})
+	msg = m.blockReply(req)
+	if ede := edeOption(msg); msg.Rcode != dns.RcodeRefused || len(msg.Ns) != 0 || ede == nil || ede.InfoCode != dns.ExtendedErrorCodeCensored || ede.ExtraText != "court order" {
+		t.Errorf("Unexpected reply %v", msg)
+	}
+
+	_ = m.block.parseEde([]string{"none"})
+	_ = m.block.parseMode([]string{"nxdomain"})
+	msg = m.blockReply(req)
+	if msg.Rcode != dns.RcodeNameError || len(msg.Ns) != 1 || msg.IsEdns0() == nil || edeOption(msg) != nil {
+		t.Errorf("Unexpected reply %v", msg)
+	}
+
+	_ = m.block.parseMode([]string{"drop"})
+	if msg := m.blockReply(req); msg != nil {
+		t.Errorf("Expected drop, got %v", msg)
+	}
+
+	for _, args := range [][]string{{}, {"drop", "now"}, {"servfail"}} {
+		if err := newBlockAction().parseMode(args); err == nil {
+			t.Errorf("%q: expected error", args)
+		}
+	}
+	for _, args := range [][]string{{}, {"none", "text"}, {"forged"}} {
+		if err := newBlockAction().parseEde(args); err == nil {
+			t.Errorf("%q: expected error", args)
+		}
+	}
+}
+
+// Legacy nxdomain stays a bare NXDOMAIN unless block or ede is configured
+func TestLegacyNxdomain(t *testing.T) {
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n"+
+		"matcher { \n name legacy \n query_names full:a.example.com \n nxdomain \n } \n"+
+		"matcher { \n name ede \n query_names full:b.example.com \n nxdomain \n ede filtered \n } \n }")
+	legacy, ede := u.subMatchers.matchers[0], u.subMatchers.matchers[1]
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	msg := legacy.blockReply(req)
+	if msg.Rcode != dns.RcodeNameError || len(msg.Ns) != 0 || msg.IsEdns0() == nil || edeOption(msg) != nil {
+		t.Errorf("Expected bare NXDOMAIN, got %v", msg)
+	}
+
+	msg = ede.blockReply(req)
+	if o := edeOption(msg); msg.Rcode != dns.RcodeNameError || len(msg.Ns) != 1 || o == nil || o.InfoCode != dns.ExtendedErrorCodeFiltered {
+		t.Errorf("Expected NXDOMAIN with SOA and EDE, got %v", msg)
+	}
+}
+
+func edeOption(msg *dns.Msg) *dns.EDNS0_EDE {
+	if o := msg.IsEdns0(); o != nil {
+		for _, opt := range o.Option {
+			if ede, ok := opt.(*dns.EDNS0_EDE); ok {
+				return ede
+			}
+		}
+	}
+	return nil
+}
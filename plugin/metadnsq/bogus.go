@@ -0,0 +1,119 @@
+package metadnsq
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ca17/datahub/plugin/pkg/netutils"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+// Addresses which hijacking resolvers answer non-existent names with, in the style of dnsmasq
+//	replies containing any of them are turned into NXDOMAIN before matchers run
+type bogusNxdomain struct {
+	tags []string     // Datahub netlist tags
+	nets []*net.IPNet // Static addresses and CIDRs
+}
+
+func (b *bogusNxdomain) String() string {
+	nets := make([]string, 0, len(b.nets))
+	for _, n := range b.nets {
+		nets = append(nets, n.String())
+	}
+	return fmt.Sprintf("tags:%v nets:%v", b.tags, nets)
+}
+
+// bogusNxdomainError is recorded as a soft failure of the upstream host
+type bogusNxdomainError struct {
+	ip net.IP
+}
+
+func (e *bogusNxdomainError) Error() string {
+	return fmt.Sprintf("bogus nxdomain answer %v", e.ip)
+}
+
+func (b *bogusNxdomain) contains(ip net.IP) bool {
+	for _, n := range b.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if len(b.tags) == 0 || hubPlugin == nil {
+		return false
+	}
+	ns, err := netutils.ParseIpNet(ip.String())
+	if err != nil {
+		return false
+	}
+	for _, tag := range b.tags {
+		if hubPlugin.MixMatchNet(tag, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite reply to NXDOMAIN if any A/AAAA answer is bogus, return *bogusNxdomainError if so
+func (b *bogusNxdomain) check(reply *dns.Msg) error {
+	if b == nil || reply.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	for _, rr := range reply.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if !b.contains(ip) {
+			continue
+		}
+
+		reply.Rcode = dns.RcodeNameError
+		reply.Answer = nil
+		reply.Ns = negativeSoa(reply, defaultAnswerTtl)
+		keepOnlyOpt(reply)
+		return &bogusNxdomainError{ip: ip}
+	}
+	return nil
+}
+
+func (uh *UpstreamHost) observeBogusNxdomain(server string, err error) {
+	log.Debugf("%v: %v", uh.Name(), err)
+	BogusNxdomainCount.WithLabelValues(server, uh.Name()).Inc()
+}
+
+// bogus_nxdomain <ip|cidr|netlist-tag>...
+func parseBogusNxdomain(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	// Multiple "bogus_nxdomain"s will be merged together
+	if u.bogusNxdomain == nil {
+		u.bogusNxdomain = &bogusNxdomain{}
+	}
+	b := u.bogusNxdomain
+	for _, arg := range args {
+		if ip := net.ParseIP(arg); ip != nil {
+			b.nets = append(b.nets, hostIPNet(ip))
+			continue
+		}
+		if _, n, err := net.ParseCIDR(arg); err == nil {
+			b.nets = append(b.nets, n)
+			continue
+		}
+		if strings.ContainsAny(arg, "/:") {
+			return c.Errf("%v: %q isn't a valid IP address or CIDR", dir, arg)
+		}
+		b.tags = append(b.tags, arg)
+	}
+	log.Infof("%v: %v", dir, b)
+	return nil
+}
@@ -0,0 +1,95 @@
+package metadnsq
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestBogusNxdomain(t *testing.T) {
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n bogus_nxdomain 198.51.100.1 \n bogus_nxdomain 203.0.113.0/24 adservers \n }")
+	b := u.bogusNxdomain
+	if len(b.nets) != 2 || len(b.tags) != 1 {
+		t.Fatalf("Expected directives merged, got %v", b)
+	}
+
+	tests := []struct {
+		answers []string
+		bogus   bool
+	}{
+		{[]string{"www.example.com. 60 IN A 192.0.2.1"}, false},
+		{[]string{"www.example.com. 60 IN A 198.51.100.1"}, true},
+		{[]string{"www.example.com. 60 IN CNAME ad.example.net.", "ad.example.net. 60 IN A 203.0.113.7"}, true},
+		{[]string{"www.example.com. 60 IN AAAA fd00::1"}, false},
+	}
+	for i, test := range tests {
+		reply := new(dns.Msg)
+		reply.SetQuestion("www.example.com.", dns.TypeA)
+		reply.SetEdns0(1232, false)
+		for _, s := range test.answers {
+			rr, _ := dns.NewRR(s)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		err := b.check(reply)
+		if (err != nil) != test.bogus {
+			t.Errorf("Test#%v: expected bogus %v, got %v", i, test.bogus, err)
+			continue
+		}
+		if !test.bogus {
+			continue
+		}
+		if reply.Rcode != dns.RcodeNameError || len(reply.Answer) != 0 || len(reply.Ns) != 1 || reply.IsEdns0() == nil {
+			t.Errorf("Test#%v: unexpected reply %v", i, reply)
+		}
+		if o := exchangeOutcome(reply, err); o != outcomeError {
+			t.Errorf("Test#%v: expected soft failure, got outcome %v", i, o)
+		}
+	}
+
+	var none *bogusNxdomain
+	if err := none.check(new(dns.Msg)); err != nil {
+		t.Errorf("Expected nil bogusNxdomain to be a no-op, got %v", err)
+	}
+}
+
+func TestSetupBogusNxdomain(t *testing.T) {
+	tests := []testCase{
+		// Negative
+		{"metadnsq . { to t1 1.2.3.4 \n bogus_nxdomain \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n bogus_nxdomain 10.0.0.0/33 \n }", true, "isn't a valid IP address or CIDR"},
+		// Positive
+		{"metadnsq . { to t1 1.2.3.4 \n bogus_nxdomain 198.51.100.1 fd00::1 isp_ads \n }", false, ""},
+	}
+
+	runSetupTests(t, tests)
+}
+
+// Bogus answers count as failed exchanges, outlier detection isn't needed to penalize the host
+func TestExchangeBogusNxdomain(t *testing.T) {
+	addr := startDualServer(t, "198.51.100.1", 0)
+	up := mustTestUpstream(t, "metadnsq . { to t1 "+addr+" \n bogus_nxdomain 198.51.100.1 \n }")
+	up.HealthCheck.Start()
+	t.Cleanup(up.HealthCheck.Stop)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	state := &request.Request{W: &remoteWriter{remote: net.ParseIP("127.0.0.1")}, Req: req}
+	host := up.hosts[0]
+	reply, bogus, err := (&MetaForward{}).exchange(context.TODO(), up, state, "dns://:53", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bogus {
+		t.Error("Expected the reply marked bogus")
+	}
+	if reply.Rcode != dns.RcodeNameError || len(reply.Answer) != 0 {
+		t.Errorf("Expected NXDOMAIN, got %v", reply)
+	}
+	if fails := atomic.LoadInt32(&host.fails); fails != 1 {
+		t.Errorf("Expected 1 fail, got %v", fails)
+	}
+}
@@ -0,0 +1,173 @@
+package metadnsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ca17/datahub/plugin/pkg/netutils"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// A canary is a well-known domain whose A records must fall inside expected networks,
+//	an upstream answering it otherwise is considered hijacked or poisoned
+type hcCanary struct {
+	name string       // FQDN of the canary domain
+	tags []string     // Expected datahub netlist tags
+	nets []*net.IPNet // Expected static CIDRs
+}
+
+func (c *hcCanary) String() string {
+	nets := make([]string, 0, len(c.nets))
+	for _, n := range c.nets {
+		nets = append(nets, n.String())
+	}
+	return fmt.Sprintf("%v tags:%v nets:%v", c.name, c.tags, nets)
+}
+
+// poisonedError is returned when a canary answer falls outside of the expected networks
+type poisonedError struct {
+	canary *hcCanary
+	ip     string
+}
+
+func (e *poisonedError) Error() string {
+	return fmt.Sprintf("canary %v answer %v not in %v %v", e.canary.name, e.ip, e.canary.tags, e.canary.nets)
+}
+
+// Return true if ip is inside any of the expected networks
+func (c *hcCanary) contains(ip net.IP) (bool, error) {
+	for _, n := range c.nets {
+		if n.Contains(ip) {
+			return true, nil
+		}
+	}
+	if len(c.tags) == 0 {
+		return false, nil
+	}
+	if hubPlugin == nil {
+		return false, fmt.Errorf("canary %v: hubPlugin not enable", c.name)
+	}
+	ns, err := netutils.ParseIpNet(ip.String())
+	if err != nil {
+		return false, err
+	}
+	for _, tag := range c.tags {
+		if hubPlugin.MixMatchNet(tag, ns) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Return *poisonedError if any A record in reply is outside of the expected networks
+func (c *hcCanary) verify(reply *dns.Msg) error {
+	found := false
+	for _, rr := range reply.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		found = true
+		ok, err := c.contains(a.A)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &poisonedError{canary: c, ip: a.A.String()}
+		}
+	}
+	if !found {
+		return fmt.Errorf("canary %v expected A answer, rcode: %v", c.name, dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// Resolve every canary through the host, stop at the first failure
+func (uh *UpstreamHost) checkCanaries() error {
+	for _, c := range uh.canaries {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, dns.TypeA)
+		req.MsgHdr.RecursionDesired = true
+		reply, err := uh.probeExchange(req)
+		if err != nil {
+			return fmt.Errorf("canary %v: %v", c.name, err)
+		}
+		if err := c.verify(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Poisoned hosts are considered down until canaries pass again
+func (uh *UpstreamHost) Poisoned() bool {
+	return atomic.LoadInt32(&uh.poisoned) != 0
+}
+
+// Update poisoned state by health check result, return true if err is a poisoning error
+func (uh *UpstreamHost) observePoison(err error) bool {
+	var pe *poisonedError
+	if !errors.As(err, &pe) {
+		if err == nil {
+			atomic.StoreInt32(&uh.poisoned, 0)
+		}
+		return false
+	}
+	if atomic.SwapInt32(&uh.poisoned, 1) == 0 {
+		log.Warningf("hc: DNS %v poisoned: %v", uh.Name(), err)
+	}
+	HealthCheckPoisonedCount.WithLabelValues(uh.Name(), pe.canary.name).Inc()
+	return true
+}
+
+// A single exchange through the host transport, used by health check queries other than the probe
+func (uh *UpstreamHost) probeExchange(req *dns.Msg) (*dns.Msg, error) {
+	if uh.IsDOH() {
+		return uh.dohExchange(context.Background(), &request.Request{Req: req})
+	}
+	proto := protoToNetwork(uh.proto)
+	if uh.proto == "dns" {
+		proto = "udp"
+	}
+	for {
+		reply, err := uh.wireFormatExchange(proto, req, dns.MinMsgSize, uh.bootstrap, uh.noIPv6, uh.hcTimeout)
+		if err == errCachedConnClosed {
+			continue
+		}
+		return reply, err
+	}
+}
+
+// canary <domain> <netlist-tag|ip|cidr>...
+func parseCanary(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+	name := args[0]
+	if _, ok := dns.IsDomainName(name); !ok {
+		return c.Errf("%v: %q isn't a valid domain name", dir, name)
+	}
+	canary := &hcCanary{name: dns.Fqdn(strings.ToLower(name))}
+	for _, arg := range args[1:] {
+		if ip := net.ParseIP(arg); ip != nil {
+			canary.nets = append(canary.nets, hostIPNet(ip))
+			continue
+		}
+		if _, n, err := net.ParseCIDR(arg); err == nil {
+			canary.nets = append(canary.nets, n)
+			continue
+		}
+		canary.tags = append(canary.tags, arg)
+	}
+	u.canaries = append(u.canaries, canary)
+	log.Infof("%v: %v", dir, canary)
+	return nil
+}
@@ -0,0 +1,47 @@
+package metadnsq
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanaryVerify(t *testing.T) {
+	_, n, _ := net.ParseCIDR("142.250.0.0/15")
+	canary := &hcCanary{name: "www.google.com.", nets: []*net.IPNet{n}}
+
+	reply := new(dns.Msg)
+	reply.SetQuestion(canary.name, dns.TypeA)
+	if err := canary.verify(reply); err == nil {
+		t.Errorf("Expected empty answer error")
+	}
+
+	rr, _ := dns.NewRR("www.google.com. 60 IN A 142.250.72.4")
+	reply.Answer = append(reply.Answer, rr)
+	if err := canary.verify(reply); err != nil {
+		t.Errorf("Expected canary to pass, got %v", err)
+	}
+
+	rr, _ = dns.NewRR("www.google.com. 60 IN A 243.185.187.39")
+	reply.Answer = append(reply.Answer, rr)
+	err := canary.verify(reply)
+	var pe *poisonedError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Expected poisoned error, got %v", err)
+	}
+
+	uh := &UpstreamHost{tag: "t1", addr: "1.2.3.4:53", proto: "dns"}
+	if !uh.observePoison(err) || !uh.Poisoned() {
+		t.Errorf("Expected host to be poisoned")
+	}
+	uh.observePoison(errors.New("i/o timeout"))
+	if !uh.Poisoned() {
+		t.Errorf("Expected host to stay poisoned on unrelated failure")
+	}
+	uh.observePoison(nil)
+	if uh.Poisoned() {
+		t.Errorf("Expected host to recover once canaries passed")
+	}
+}
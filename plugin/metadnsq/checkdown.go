@@ -6,6 +6,9 @@ import "sync/atomic"
 // Taken from https://github.com/coredns/proxy/proxy/down.go
 var checkDownFunc = func(u *reloadableUpstream) UpstreamHostDownFunc {
 	return func(uh *UpstreamHost) bool {
+		if uh.Ejected() || uh.Poisoned() {
+			return true
+		}
 		fails := atomic.LoadInt32(&uh.fails)
 		return fails >= u.maxFails && u.maxFails > 0
 	}
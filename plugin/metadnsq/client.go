@@ -0,0 +1,88 @@
+package metadnsq
+
+import (
+	"net"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+)
+
+// Return the client address used by matchers and force_ecs, empty if it's unknown
+//	remote: the source address of the request
+//	ecs: the address in the request ECS option, only honored if sent by trusted forwarders
+//	ecs_then_remote: same as ecs, fallback to the source address if ECS isn't available
+func (u *reloadableUpstream) clientIP(state *request.Request) string {
+	remote := state.IP()
+	if u.clientSource == "" || u.clientSource == clientSourceRemote {
+		return remote
+	}
+
+	if u.isTrustedForwarder(remote) {
+		// Source prefix length of 0 means client doesn't want its address to be used
+		if ecs := getMsgECS(state.Req); ecs != nil && ecs.SourceNetmask != 0 && ecs.Address != nil {
+			return ecs.Address.String()
+		}
+	}
+	if u.clientSource == clientSourceEcsThenRemote {
+		return remote
+	}
+	return ""
+}
+
+func (u *reloadableUpstream) isTrustedForwarder(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range u.trustedForwarders {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client_source remote
+// client_source ecs|ecs_then_remote <trusted-forwarder-ip|cidr>...
+func parseClientSource(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	switch mode := args[0]; mode {
+	case clientSourceRemote:
+		if len(args) != 1 {
+			return c.Errf("%v: %v takes no trusted forwarder", dir, mode)
+		}
+	case clientSourceEcs, clientSourceEcsThenRemote:
+		if len(args) == 1 {
+			return c.Errf("%v: %v expects at least one trusted forwarder", dir, mode)
+		}
+	default:
+		return c.Errf("%v: unknown client source %q", dir, mode)
+	}
+
+	var trusted []*net.IPNet
+	for _, arg := range args[1:] {
+		if ip := net.ParseIP(arg); ip != nil {
+			trusted = append(trusted, hostIPNet(ip))
+			continue
+		}
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return c.Errf("%v: %q isn't an IP address or CIDR", dir, arg)
+		}
+		trusted = append(trusted, n)
+	}
+	u.clientSource = args[0]
+	u.trustedForwarders = trusted
+	log.Infof("%v: %v trusted: %v", dir, u.clientSource, u.trustedForwarders)
+	return nil
+}
+
+const (
+	clientSourceRemote        = "remote"
+	clientSourceEcs           = "ecs"
+	clientSourceEcsThenRemote = "ecs_then_remote"
+)
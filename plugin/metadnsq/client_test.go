@@ -0,0 +1,70 @@
+package metadnsq
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// A no-op dns.ResponseWriter with given remote address
+type remoteWriter struct {
+	eventWriter
+	remote net.IP
+}
+
+func (w *remoteWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: w.remote, Port: 53}
+}
+
+func newClientRequest(remote, ecs string) *request.Request {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if ecs != "" {
+		ip := net.ParseIP(ecs).To4()
+		setECS(req, newEDNS0Subnet(ip, 24, false))
+	}
+	return &request.Request{W: &remoteWriter{remote: net.ParseIP(remote)}, Req: req}
+}
+
+func TestClientSource(t *testing.T) {
+	tests := []struct {
+		config   string
+		remote   string
+		ecs      string
+		expected string
+	}{
+		{"", "10.0.0.1", "1.2.3.0", "10.0.0.1"},
+		{"client_source remote", "10.0.0.1", "1.2.3.0", "10.0.0.1"},
+		{"client_source ecs 10.0.0.0/8", "10.0.0.1", "1.2.3.0", "1.2.3.0"},
+		{"client_source ecs 10.0.0.0/8", "10.0.0.1", "", ""},
+		{"client_source ecs 10.0.0.0/8", "192.168.1.1", "1.2.3.0", ""},
+		{"client_source ecs_then_remote 10.0.0.1", "10.0.0.1", "1.2.3.0", "1.2.3.0"},
+		{"client_source ecs_then_remote 10.0.0.1", "10.0.0.1", "", "10.0.0.1"},
+		{"client_source ecs_then_remote 10.0.0.1", "10.0.0.2", "1.2.3.0", "10.0.0.2"},
+	}
+	for i, test := range tests {
+		u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n "+test.config+" \n }")
+		ip := u.clientIP(newClientRequest(test.remote, test.ecs))
+		if ip != test.expected {
+			t.Errorf("Test#%v %q remote: %v ecs: %v expected %q, got %q",
+				i, test.config, test.remote, test.ecs, test.expected, ip)
+		}
+	}
+}
+
+func TestSetupClientSource(t *testing.T) {
+	tests := []testCase{
+		// Negative
+		{"metadnsq . { to t1 1.2.3.4 \n client_source \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n client_source foo \n }", true, "unknown client source"},
+		{"metadnsq . { to t1 1.2.3.4 \n client_source ecs \n }", true, "expects at least one trusted forwarder"},
+		{"metadnsq . { to t1 1.2.3.4 \n client_source remote 10.0.0.1 \n }", true, "takes no trusted forwarder"},
+		{"metadnsq . { to t1 1.2.3.4 \n client_source ecs 10.0.0.0/33 \n }", true, "isn't an IP address or CIDR"},
+		// Positive
+		{"metadnsq . { to t1 1.2.3.4 \n client_source ecs 10.0.0.1 fd00::/8 \n }", false, ""},
+	}
+
+	runSetupTests(t, tests)
+}
@@ -0,0 +1,207 @@
+package metadnsq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ca17/datahub/plugin/pkg/netutils"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ChinaDNS-style resolution, hosts of both tags are queried in parallel
+//	the domestic reply is used if all its A/AAAA answers are inside the trusted netlists,
+//	otherwise the foreign reply is used, once either reply arrives the other one is waited for at most `wait`
+//	dual <domestic-tag> <foreign-tag> <netlist-tag>... [wait <duration>] [trust_empty]
+type dualResolve struct {
+	domestic   string
+	foreign    string
+	trust      []string // Datahub netlist/geoip tags, i.e. cn
+	wait       time.Duration
+	trustEmpty bool // Trust domestic NXDOMAIN and NODATA replies, which may be forged as well
+}
+
+func (d *dualResolve) String() string {
+	return fmt.Sprintf("domestic:%v foreign:%v trust:%v wait:%v trust_empty:%v", d.domestic, d.foreign, d.trust, d.wait, d.trustEmpty)
+}
+
+// Return true if all A/AAAA answers of reply are inside the trusted netlists
+// Replies without any address are trusted only if trust_empty is set, while failures are never trusted
+func (d *dualResolve) trusted(reply *dns.Msg) bool {
+	if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return false
+	}
+	addrs := 0
+	for _, rr := range reply.Answer {
+		var ip string
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		default:
+			continue
+		}
+		addrs++
+		if hubPlugin == nil {
+			return false
+		}
+		ns, err := netutils.ParseIpNet(ip)
+		if err != nil {
+			return false
+		}
+		matched := false
+		for _, tag := range d.trust {
+			if hubPlugin.MixMatchNet(tag, ns) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return addrs != 0 || d.trustEmpty
+}
+
+type dualResult struct {
+	host  *UpstreamHost
+	reply *dns.Msg
+	bogus bool // Converted by bogus_nxdomain
+	err   error
+}
+
+// Resolve through both tags and arbitrate, return the host whose reply is chosen, nil if no host is available
+// Request is sent as is to both tags, so ECS set by force_ecs is honored by both of them
+func (r *MetaForward) dualExchange(ctx context.Context, upstream *reloadableUpstream, state *request.Request, server string) (*UpstreamHost, *dns.Msg, error) {
+	d := upstream.dual
+	domestic, foreign := upstream.SelectByTag(d.domestic), upstream.SelectByTag(d.foreign)
+	switch {
+	case domestic == nil && foreign == nil:
+		return nil, nil, errNoHealthy
+	case foreign == nil:
+		// Nothing to arbitrate against, untrusted domestic replies are counted as fallbacks
+		reply, bogus, err := r.exchange(ctx, upstream, state, server, domestic)
+		if err == nil {
+			choice := dualChoiceFallback
+			if !bogus && d.trusted(reply) {
+				choice = dualChoiceDomestic
+			}
+			DualChoiceCount.WithLabelValues(server, choice).Inc()
+		}
+		return domestic, reply, err
+	case domestic == nil:
+		reply, _, err := r.exchange(ctx, upstream, state, server, foreign)
+		if err == nil {
+			DualChoiceCount.WithLabelValues(server, dualChoiceForeignFallback).Inc()
+		}
+		return foreign, reply, err
+	}
+	log.Debugf("Dual upstream hosts %v and %v are selected", domestic.Name(), foreign.Name())
+
+	query := func(host *UpstreamHost, ch chan<- *dualResult) {
+		// Request is copied since exchanges may modify it, i.e. DoH clears message ID
+		st := &request.Request{W: state.W, Req: state.Req.Copy()}
+		reply, bogus, err := r.exchange(ctx, upstream, st, server, host)
+		ch <- &dualResult{host: host, reply: reply, bogus: bogus, err: err}
+	}
+	dch, fch := make(chan *dualResult, 1), make(chan *dualResult, 1)
+	go query(domestic, dch)
+	go query(foreign, fch)
+
+	// Domestic reply is preferred, it's waited for at most `wait` once a usable foreign reply arrives
+	var dr, fr *dualResult
+	select {
+	case dr = <-dch:
+	case fr = <-fch:
+		if fr.err != nil {
+			dr = <-dch
+			break
+		}
+		select {
+		case dr = <-dch:
+		case <-time.After(d.wait):
+			log.Debugf("%q: domestic reply not received in %v", state.Name(), d.wait)
+			DualChoiceCount.WithLabelValues(server, dualChoiceForeign).Inc()
+			return fr.host, fr.reply, nil
+		}
+	}
+	// Bogus NXDOMAIN means the domestic reply was poisoned, it's never trusted
+	if dr.err == nil && !dr.bogus && d.trusted(dr.reply) {
+		DualChoiceCount.WithLabelValues(server, dualChoiceDomestic).Inc()
+		return dr.host, dr.reply, nil
+	}
+
+	if fr == nil {
+		if dr.err != nil {
+			// Nothing to fall back to
+			fr = <-fch
+		} else {
+			select {
+			case fr = <-fch:
+			case <-time.After(d.wait):
+				log.Debugf("%q: foreign reply not received in %v", state.Name(), d.wait)
+			}
+		}
+	}
+	if fr != nil && fr.err == nil {
+		DualChoiceCount.WithLabelValues(server, dualChoiceForeign).Inc()
+		return fr.host, fr.reply, nil
+	}
+
+	// Foreign query failed or is too slow, untrusted domestic reply is better than nothing
+	if dr.err == nil {
+		DualChoiceCount.WithLabelValues(server, dualChoiceFallback).Inc()
+		return dr.host, dr.reply, nil
+	}
+	return dr.host, nil, dr.err
+}
+
+// dual <domestic-tag> <foreign-tag> <netlist-tag>... [wait <duration>] [trust_empty]
+func parseDual(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+	d := &dualResolve{domestic: args[0], foreign: args[1], wait: defaultDualWait}
+	if d.domestic == d.foreign {
+		return c.Errf("%v: domestic and foreign tags must differ", dir)
+	}
+	for i := 2; i < len(args); i++ {
+		switch args[i] {
+		case "wait":
+			if i+1 == len(args) {
+				return c.Errf("%v: wait expects a duration", dir)
+			}
+			i++
+			dur, err := parseDuration0(dir, args[i])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			d.wait = dur
+		case "trust_empty":
+			d.trustEmpty = true
+		default:
+			d.trust = append(d.trust, args[i])
+		}
+	}
+	if len(d.trust) == 0 {
+		return c.Errf("%v: expects at least one trusted netlist tag", dir)
+	}
+	u.dual = d
+	log.Infof("%v: %v", dir, d)
+	return nil
+}
+
+const (
+	defaultDualWait = 200 * time.Millisecond
+
+	dualChoiceDomestic = "domestic"
+	dualChoiceForeign  = "foreign"
+	dualChoiceFallback = "domestic_fallback"
+	// Only foreign hosts are available
+	dualChoiceForeignFallback = "foreign_fallback"
+)
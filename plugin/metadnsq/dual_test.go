@@ -0,0 +1,100 @@
+package metadnsq
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Start a UDP DNS server answering A queries with ip after delay, NXDOMAIN if ip is empty
+func startDualServer(t *testing.T, ip string, delay time.Duration) string {
+	return startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(delay)
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		if ip == "" {
+			msg.Rcode = dns.RcodeNameError
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		_ = w.WriteMsg(msg)
+	})
+}
+
+func TestDualExchange(t *testing.T) {
+	tests := []struct {
+		domesticIP     string
+		foreignIP      string
+		domesticDelay  time.Duration
+		foreignDelay   time.Duration
+		foreignDrained bool
+		options        string // Appended to the dual directive and the server block
+		expectedTag    string
+		expectedRcode  int
+	}{
+		// Replies without any address aren't trusted by default
+		{"", "10.0.0.2", 0, 0, false, "", "foreign", dns.RcodeSuccess},
+		{"", "10.0.0.2", 0, 0, false, " trust_empty", "domestic", dns.RcodeNameError},
+		// Bogus NXDOMAIN is never trusted, even if empty replies are
+		{"198.51.100.1", "10.0.0.2", 0, 0, false, " trust_empty \n bogus_nxdomain 198.51.100.1", "foreign", dns.RcodeSuccess},
+		// Without datahub, domestic addresses are never trusted
+		{"10.0.0.1", "10.0.0.2", 0, 0, false, "", "foreign", dns.RcodeSuccess},
+		// Foreign reply is too slow, fall back to domestic
+		{"10.0.0.1", "10.0.0.2", 0, 500 * time.Millisecond, false, "", "domestic", dns.RcodeSuccess},
+		// Domestic reply is too slow, the foreign reply isn't held back
+		{"10.0.0.1", "10.0.0.2", time.Second, 0, false, "", "foreign", dns.RcodeSuccess},
+		// No foreign host is available, the domestic reply is used as is
+		{"10.0.0.1", "10.0.0.2", 0, 0, true, "", "domestic", dns.RcodeSuccess},
+		{"198.51.100.1", "10.0.0.2", 0, 0, true, " \n bogus_nxdomain 198.51.100.1", "domestic", dns.RcodeNameError},
+	}
+
+	for i, test := range tests {
+		domestic := startDualServer(t, test.domesticIP, test.domesticDelay)
+		foreign := startDualServer(t, test.foreignIP, test.foreignDelay)
+		up := mustTestUpstream(t, "metadnsq . { to domestic "+domestic+" \n to foreign "+foreign+
+			" \n dual domestic foreign cn wait 100ms"+test.options+" \n }")
+		up.HealthCheck.Start()
+		t.Cleanup(up.HealthCheck.Stop)
+		up.hosts.withTag("foreign")[0].SetDrained(test.foreignDrained)
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		state := &request.Request{W: &remoteWriter{remote: net.ParseIP("127.0.0.1")}, Req: req}
+		start := time.Now()
+		host, reply, err := (&MetaForward{}).dualExchange(context.TODO(), up, state, "dns://:53")
+		if err != nil {
+			t.Errorf("Test#%v: %v", i, err)
+			continue
+		}
+		if host.tag != test.expectedTag || reply.Rcode != test.expectedRcode {
+			t.Errorf("Test#%v: expected %v rcode %v, got %v %v", i, test.expectedTag, test.expectedRcode, host.tag, reply)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Test#%v: expected the reply within wait, took %v", i, elapsed)
+		}
+	}
+}
+
+func TestSetupDual(t *testing.T) {
+	tests := []testCase{
+		// Negative
+		{"metadnsq . { to t1 1.2.3.4 \n dual t1 t2 \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n dual t1 t1 cn \n }", true, "must differ"},
+		{"metadnsq . { to t1 1.2.3.4 \n dual t1 t2 wait 100ms \n }", true, "at least one trusted netlist tag"},
+		{"metadnsq . { to t1 1.2.3.4 \n dual t1 t2 cn wait \n }", true, "expects a duration"},
+		{"metadnsq . { to t1 1.2.3.4 \n dual t1 t2 cn wait foo \n }", true, "invalid duration"},
+		{"metadnsq . { to t1 1.2.3.4 \n dual t1 t2 cn \n }", true, "no host of tag \"t2\""},
+		{"metadnsq . { to t2 1.2.3.4 \n dual t1 t2 cn \n }", true, "no host of tag \"t1\""},
+		// Positive
+		{"metadnsq . { to t1 1.2.3.4 \n to t2 8.8.8.8 \n dual t1 t2 cn hk \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n to t2 8.8.8.8 \n dual t1 t2 cn wait 300ms \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n to t2 8.8.8.8 \n dual t1 t2 cn trust_empty wait 300ms \n }", false, ""},
+	}
+
+	runSetupTests(t, tests)
+}
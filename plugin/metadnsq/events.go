@@ -0,0 +1,236 @@
+package metadnsq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Health state transition hooks of upstream hosts
+type stateHooks struct {
+	notify  string // datahub notify channel, empty to disable
+	webhook string // Local webhook URL, empty to disable
+	client  *http.Client
+	queue   chan *stateEvent // Events are notified and posted in order by eventWorker()
+}
+
+// Health state of an upstream host, transitions are detected by UpstreamHost.updateState()
+//	wherever availability may change, and by HealthCheck.stateWorker() for time-based recoveries
+type hostState struct {
+	sync.Mutex
+	down   bool
+	since  time.Time
+	reason string // Latest reason which may lead to a transition
+}
+
+// stateEvent is emitted when an upstream host flips up->down or down->up
+type stateEvent struct {
+	Host             string    `json:"host"`
+	Tag              string    `json:"tag"`
+	State            string    `json:"state"`
+	Reason           string    `json:"reason"`
+	PreviousState    string    `json:"previous_state"`
+	PreviousDuration string    `json:"previous_duration"`
+	Time             time.Time `json:"time"`
+}
+
+func (e *stateEvent) String() string {
+	return fmt.Sprintf("host=%v tag=%v state=%v reason=%q previous=%v duration=%v",
+		e.Host, e.Tag, e.State, e.Reason, e.PreviousState, e.PreviousDuration)
+}
+
+func stateString(down bool) string {
+	if down {
+		return "down"
+	}
+	return "up"
+}
+
+// Record the reason of latest health related event, reported along with next transition
+func (uh *UpstreamHost) setStateReason(reason string) {
+	uh.state.Lock()
+	uh.state.reason = reason
+	uh.state.Unlock()
+}
+
+// Reset health state, used when upstream starts
+func (uh *UpstreamHost) resetState() {
+	uh.state.Lock()
+	uh.state.down = false
+	uh.state.since = time.Now()
+	uh.state.Unlock()
+	HealthStateUp.WithLabelValues(uh.Name(), uh.tag).Set(1)
+}
+
+// Emit a transition event if availability differs from the previous observed state
+func (uh *UpstreamHost) updateState() {
+	uh.state.Lock()
+	down := unavailable(uh)
+	if uh.state.down == down {
+		uh.state.Unlock()
+		return
+	}
+	now := time.Now()
+	var prev time.Duration
+	if !uh.state.since.IsZero() {
+		prev = now.Sub(uh.state.since)
+	}
+	uh.state.down = down
+	uh.state.since = now
+	reason := uh.state.reason
+	uh.state.Unlock()
+
+	e := &stateEvent{
+		Host:             uh.Name(),
+		Tag:              uh.tag,
+		State:            stateString(down),
+		Reason:           reason,
+		PreviousState:    stateString(!down),
+		PreviousDuration: prev.Round(time.Millisecond).String(),
+		Time:             now,
+	}
+	if down {
+		log.Warningf("hc: transition %v", e)
+		HealthStateUp.WithLabelValues(uh.Name(), uh.tag).Set(0)
+		HealthCheckAllDownCount.WithLabelValues(uh.Name()).Inc()
+	} else {
+		log.Infof("hc: transition %v", e)
+		HealthStateUp.WithLabelValues(uh.Name(), uh.tag).Set(1)
+	}
+	HealthStateTransitionCount.WithLabelValues(uh.Name(), uh.tag, e.State).Inc()
+	uh.hooks.fire(e)
+}
+
+// Queue the event, transitions are detected on hot paths so hooks never run synchronously
+func (h *stateHooks) fire(e *stateEvent) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.queue <- e:
+	default:
+		log.Warningf("hc: event queue full, drop event %v", e)
+	}
+}
+
+func (h *stateHooks) eventWorker(stop chan struct{}) {
+	for {
+		select {
+		case e := <-h.queue:
+			if h.notify != "" {
+				h.notifyHub(e)
+			}
+			if h.webhook != "" {
+				h.post(e)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *stateHooks) notifyHub(e *stateEvent) {
+	if hubPlugin == nil {
+		log.Warningf("hc: hubPlugin not enable, skip notify %v", h.notify)
+		return
+	}
+	hubPlugin.NotifyMessage(h.notify, newStateEventRequest(e))
+}
+
+func (h *stateHooks) post(e *stateEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("hc: webhook marshal event failed: %v", err)
+		return
+	}
+	resp, err := h.client.Post(h.webhook, mimeTypeJson, bytes.NewReader(body))
+	if err != nil {
+		log.Warningf("hc: webhook %v failed: %v", h.webhook, err)
+		return
+	}
+	defer Close(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		log.Warningf("hc: webhook %v bad status code: %v", h.webhook, resp.StatusCode)
+	}
+}
+
+// The datahub notify API works on DNS requests, so the event is carried by a synthesized one:
+//	<state>.<tag>.metadnsq. IN TXT with the event itself in answer section
+func newStateEventRequest(e *stateEvent) *request.Request {
+	name := dns.Fqdn(e.State + "." + e.Tag + "." + pluginName)
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeTXT)
+	req.Answer = append(req.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{e.String()},
+	})
+	return &request.Request{W: &eventWriter{host: e.Host}, Req: req}
+}
+
+// A no-op dns.ResponseWriter whose remote address is the upstream host
+type eventWriter struct {
+	host string
+}
+
+func (w *eventWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero}
+}
+
+func (w *eventWriter) RemoteAddr() net.Addr {
+	addr := &net.UDPAddr{IP: net.IPv4zero}
+	if u, err := url.Parse(w.host); err == nil {
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			addr.IP = ip
+		}
+	}
+	return addr
+}
+
+func (w *eventWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (w *eventWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *eventWriter) Close() error                { return nil }
+func (w *eventWriter) TsigStatus() error           { return nil }
+func (w *eventWriter) TsigTimersOnly(bool)         {}
+func (w *eventWriter) Hijack()                     {}
+
+func parseStateHooks(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if u.hooks == nil {
+		u.hooks = &stateHooks{queue: make(chan *stateEvent, eventQueueSize)}
+	}
+	switch dir {
+	case "state_notify":
+		u.hooks.notify = args[0]
+	case "state_webhook":
+		if _, err := url.ParseRequestURI(args[0]); err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.hooks.webhook = args[0]
+		u.hooks.client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	log.Infof("%v: %v", dir, args[0])
+	return nil
+}
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	eventQueueSize        = 64
+	stateSweepInterval    = 1 * time.Second
+)
@@ -0,0 +1,100 @@
+package metadnsq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStateTransitionWebhook(t *testing.T) {
+	events := make(chan stateEvent, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e stateEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("Bad webhook body: %v", err)
+		}
+		events <- e
+	}))
+	defer server.Close()
+
+	u := &reloadableUpstream{HealthCheck: &HealthCheck{maxFails: 1}}
+	hooks := &stateHooks{webhook: server.URL, client: server.Client(), queue: make(chan *stateEvent, eventQueueSize)}
+	stop := make(chan struct{})
+	defer close(stop)
+	go hooks.eventWorker(stop)
+
+	uh := &UpstreamHost{
+		tag:      "t1",
+		proto:    "dns",
+		addr:     "1.1.1.1:53",
+		downFunc: checkDownFunc(u),
+		hooks:    hooks,
+	}
+	uh.resetState()
+
+	uh.setStateReason("health check failed: i/o timeout")
+	uh.fails = 1
+	// Down() is a pure read, transitions are only emitted by updateState()
+	if !uh.Down() {
+		t.Errorf("Expected %v to be down", uh.Name())
+	}
+	uh.updateState()
+	uh.updateState()
+	uh.setStateReason("health check passed")
+	uh.fails = 0
+	uh.updateState()
+	// Drain flips availability as well
+	uh.SetDrained(true)
+	uh.SetDrained(true)
+	uh.SetDrained(false)
+
+	for _, expected := range []string{"down", "up", "down", "up"} {
+		select {
+		case e := <-events:
+			if e.State != expected || e.Host != uh.Name() || e.Tag != uh.tag {
+				t.Errorf("Expected %v event of %v, got %+v", expected, uh.Name(), e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %v event", expected)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Ejection ends without any health check or exchange, the state worker emits the recovery
+func TestStateWorkerSweep(t *testing.T) {
+	hooks := &stateHooks{queue: make(chan *stateEvent, eventQueueSize)}
+	hc := &HealthCheck{stop: make(chan struct{}), maxFails: 1}
+	uh := &UpstreamHost{
+		tag:      "t1",
+		proto:    "dns",
+		addr:     "1.1.1.1:53",
+		downFunc: checkDownFunc(&reloadableUpstream{HealthCheck: hc}),
+		stats:    newHostStats(),
+		hooks:    hooks,
+	}
+	hc.hosts = UpstreamHostPool{uh}
+	uh.resetState()
+
+	uh.stats.ejectedUntil = time.Now().Add(stateSweepInterval / 2)
+	uh.updateState()
+	go hc.stateWorker()
+	defer close(hc.stop)
+
+	for _, expected := range []string{"down", "up"} {
+		select {
+		case e := <-hooks.queue:
+			if e.State != expected {
+				t.Errorf("Expected %v event, got %v", expected, e)
+			}
+		case <-time.After(3 * stateSweepInterval):
+			t.Fatalf("Timed out waiting for %v event", expected)
+		}
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ca17/datahub/plugin/pkg/netutils"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
@@ -45,6 +46,7 @@ type Transport struct {
 	dial  chan string
 	yield chan *persistConn
 	ret   chan *persistConn
+	count chan chan [typeTotalCount]int // Query pooled connection count of each bucket
 	stop  chan struct{}
 }
 
@@ -56,6 +58,7 @@ func newTransport() *Transport {
 		dial:        make(chan string),
 		yield:       make(chan *persistConn),
 		ret:         make(chan *persistConn),
+		count:       make(chan chan [typeTotalCount]int),
 		stop:        make(chan struct{}),
 	}
 }
@@ -88,6 +91,13 @@ func (t *Transport) connManager() {
 			transType := t.transportTypeFromConn(pc)
 			t.conns[transType] = append(t.conns[transType], pc)
 
+		case ch := <-t.count:
+			var n [typeTotalCount]int
+			for transType, stack := range t.conns {
+				n[transType] = len(stack)
+			}
+			ch <- n
+
 		case <-ticker.C:
 			t.cleanup(false)
 
@@ -155,6 +165,24 @@ func (t *Transport) Yield(pc *persistConn) {
 	}
 }
 
+// ConnCount returns pooled connection count of each transport type
+// All zeros are returned if connection manager isn't running
+func (t *Transport) ConnCount() [typeTotalCount]int {
+	ch := make(chan [typeTotalCount]int, 1)
+	select {
+	case t.count <- ch:
+		return <-ch
+	case <-t.stop:
+	case <-time.After(yieldTimeout):
+	}
+	return [typeTotalCount]int{}
+}
+
+// AvgDialTime returns the cumulative moving average dial time
+func (t *Transport) AvgDialTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.avgDialTime))
+}
+
 // Start starts the transport's connection manager.
 func (t *Transport) Start() { go t.connManager() }
 
@@ -172,14 +200,26 @@ type UpstreamHost struct {
 	addr  string // IP:PORT
 
 	fails    int32                // Fail count
+	inflight int32                // Outstanding exchange count
+	drained  int32                // Non-zero if the host is drained for maintenance
+	poisoned int32                // Non-zero if the host failed canary checks
 	downFunc UpstreamHostDownFunc // This function should be side-effect safe
 
-	c *dns.Client // DNS client used for health check
+	probe     *hcProbe      // Health check query and its expectations
+	hcTimeout time.Duration // Timeout of a single health check exchange
+	hcTcp     bool          // Probe dns:// hosts over TCP as well
+	canaries  []*hcCanary   // Poisoning detection domains checked along with the probe
+	stats     *hostStats    // Live traffic stats for outlier detection, nil if disabled
+
+	state hostState   // Last observed health state
+	hooks *stateHooks // Health state transition hooks, nil if disabled
 
 	// Transport settings related to this upstream host
 	// Currently, it's the same as HealthCheck.transport since Caddy doesn't over nested blocks
 	// XXX: We may support per-upstream specific transport once Caddy supported nesting blocks in future
 	transport *Transport
+	bootstrap []string // Bootstrap DNS in IP:Port combo, inherited from reloadableUpstream
+	noIPv6    bool
 
 	httpClient         *http.Client
 	requestContentType string
@@ -339,6 +379,10 @@ func dialTimeout(network, address string, timeout time.Duration, bootstrap []str
 //	#1	true if it's a cached connection
 //	#2	error(if any)
 func (uh *UpstreamHost) Dial(proto string, bootstrap []string, noIPv6 bool) (*persistConn, bool, error) {
+	return uh.dial(proto, bootstrap, noIPv6, uh.transport.dialTimeout())
+}
+
+func (uh *UpstreamHost) dial(proto string, bootstrap []string, noIPv6 bool, timeout time.Duration) (*persistConn, bool, error) {
 	if uh.proto != "dns" {
 		proto = protoToNetwork(uh.proto)
 	}
@@ -350,7 +394,6 @@ func (uh *UpstreamHost) Dial(proto string, bootstrap []string, noIPv6 bool) (*pe
 	}
 
 	reqTime := time.Now()
-	timeout := uh.transport.dialTimeout()
 	if proto == "tcp-tls" {
 		conn, err := dialTimeoutWithTLS(proto, uh.addr, uh.transport.tlsConfig, timeout, bootstrap, noIPv6)
 		uh.transport.updateDialTimeout(time.Since(reqTime))
@@ -418,12 +461,60 @@ func (uh *UpstreamHost) dohExchange(ctx context.Context, state *request.Request)
 	}
 }
 
+// Drained checks whether the host is drained manually
+// A drained host takes no new traffic while its health check keeps running
+func (uh *UpstreamHost) Drained() bool {
+	return atomic.LoadInt32(&uh.drained) != 0
+}
+
+// SetDrained drains or re-enables the host
+func (uh *UpstreamHost) SetDrained(drained bool) {
+	var v int32
+	if drained {
+		v = 1
+	}
+	if atomic.SwapInt32(&uh.drained, v) != v {
+		log.Infof("Upstream host %v tag: %v drained: %v", uh.Name(), uh.tag, drained)
+		if drained {
+			uh.setStateReason("drained")
+		} else {
+			uh.setStateReason("undrained")
+		}
+		uh.updateState()
+	}
+}
+
+// Inflight returns the number of exchanges currently in progress
+func (uh *UpstreamHost) Inflight() int32 {
+	return atomic.LoadInt32(&uh.inflight)
+}
+
 func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bootstrap []string, noIPv6 bool) (*dns.Msg, error) {
+	atomic.AddInt32(&uh.inflight, 1)
+	defer atomic.AddInt32(&uh.inflight, -1)
+
 	if uh.IsDOH() {
 		return uh.dohExchange(ctx, state)
 	}
+	return uh.wireFormatExchange(state.Proto(), state.Req, state.Size(), bootstrap, noIPv6, 0)
+}
 
-	pc, cached, err := uh.Dial(state.Proto(), bootstrap, noIPv6)
+// Send req over a pooled connection of the given protocol
+// The reply(if any) is returned along with read error so health check can inspect malformed responses
+// A non-zero timeout bounds the whole exchange(dial, write and read), like dns.Client.Timeout does
+func (uh *UpstreamHost) wireFormatExchange(proto string, req *dns.Msg, udpSize int, bootstrap []string, noIPv6 bool, timeout time.Duration) (*dns.Msg, error) {
+	dialTimeout := uh.transport.dialTimeout()
+	writeDeadline := time.Now().Add(maxWriteTimeout)
+	readDeadline := time.Now().Add(maxReadTimeout)
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		if timeout < dialTimeout {
+			dialTimeout = timeout
+		}
+		writeDeadline, readDeadline = deadline, deadline
+	}
+
+	pc, cached, err := uh.dial(proto, bootstrap, noIPv6, dialTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -433,13 +524,13 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		log.Debugf("New connection established for %v", uh.Name())
 	}
 
-	pc.c.UDPSize = uint16(state.Size())
+	pc.c.UDPSize = uint16(udpSize)
 	if pc.c.UDPSize < dns.MinMsgSize {
 		pc.c.UDPSize = dns.MinMsgSize
 	}
 
-	_ = pc.c.SetWriteDeadline(time.Now().Add(maxWriteTimeout))
-	if err := pc.c.WriteMsg(state.Req); err != nil {
+	_ = pc.c.SetWriteDeadline(writeDeadline)
+	if err := pc.c.WriteMsg(req); err != nil {
 		Close(pc.c)
 		if err == io.EOF && cached {
 			return nil, errCachedConnClosed
@@ -447,41 +538,55 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		return nil, err
 	}
 
-	_ = pc.c.SetReadDeadline(time.Now().Add(maxReadTimeout))
+	_ = pc.c.SetReadDeadline(readDeadline)
 	ret, err := pc.c.ReadMsg()
 	if err != nil {
 		Close(pc.c)
 		if err == io.EOF && cached {
 			return nil, errCachedConnClosed
 		}
-		return nil, err
+		return ret, err
 	}
-	if state.Req.Id != ret.Id {
+	if req.Id != ret.Id {
 		Close(pc.c)
 		// Unlike coredns/plugin/forward/connect.go drop out-of-order responses
 		//	we pursuing not to tolerate such error
 		// Thus we have some time to retry for another upstream, for example
 		return nil, errors.New(fmt.Sprintf(
 			"met out-of-order response\nid: %v cached: %v name: %q\nresponse:\n%v",
-			state.Req.Id, cached, state.Name(), ret))
+			req.Id, cached, req.Question[0].Name, ret))
 	}
 
 	uh.transport.Yield(pc)
 	return ret, nil
 }
 
-// For health check we send to . IN NS +norec message to the upstream.
-// Dial timeouts and empty replies are considered fails
+// For health check we send the probe query(. IN NS by default) to the upstream.
+// Dial timeouts, empty replies and replies failed to meet the probe expectations are considered fails
 // 	basically anything else constitutes a healthy upstream.
+// Canaries are resolved afterwards, a poisoned host is marked down until its canaries pass again.
 func (uh *UpstreamHost) Check() error {
-	if err, rtt := uh.send(); err != nil {
+	err, rtt := uh.send()
+	if err == nil {
+		err = uh.checkCanaries()
+	}
+	if uh.observePoison(err) {
+		uh.setStateReason(fmt.Sprintf("poisoned: %v", err))
+		uh.updateState()
+		return err
+	}
+	if err != nil {
 		HealthCheckFailureCount.WithLabelValues(uh.Name()).Inc()
+		uh.setStateReason(fmt.Sprintf("health check failed: %v", err))
 		atomic.AddInt32(&uh.fails, 1)
 		log.Warningf("hc: DNS %v failed times:%d rtt: %v err: %v", uh.Name(), uh.fails, rtt, err)
+		uh.updateState()
 		return err
 	} else {
+		uh.setStateReason("health check passed")
 		// Reset failure counter once health check success
 		atomic.StoreInt32(&uh.fails, 0)
+		uh.updateState()
 		return nil
 	}
 }
@@ -490,18 +595,27 @@ func (uh *UpstreamHost) send() (error, time.Duration) {
 	if uh.IsDOH() {
 		return uh.dohSend()
 	}
-	return uh.udpWireFormatSend()
+	// Classic DNS hosts are probed over UDP, and over TCP as well if health_check tcp is set
+	if uh.proto == "dns" {
+		err, rtt := uh.wireFormatSend("udp")
+		if err != nil || !uh.hcTcp {
+			return err, rtt
+		}
+		return uh.wireFormatSend("tcp")
+	}
+	return uh.wireFormatSend(protoToNetwork(uh.proto))
 }
 
 func (uh *UpstreamHost) dohSend() (error, time.Duration) {
-	req := &dns.Msg{}
-	req.SetQuestion(".", dns.TypeNS)
-	req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
+	req := uh.probe.newMsg(uh.transport.recursionDesired)
 	state := &request.Request{Req: req}
 	t := time.Now()
 	msg, err := uh.dohExchange(context.Background(), state)
 	rtt := time.Since(t)
-	if err != nil && msg != nil {
+	if err == nil {
+		return uh.probe.verify(msg), rtt
+	}
+	if msg != nil {
 		if msg.Response || msg.Opcode == dns.OpcodeQuery {
 			log.Warningf("hc: Correct DNS %v malformed response  err: %v msg: %v", uh.Name(), err, msg)
 			err = nil
@@ -510,45 +624,146 @@ func (uh *UpstreamHost) dohSend() (error, time.Duration) {
 	return err, rtt
 }
 
-func (uh *UpstreamHost) udpWireFormatSend() (error, time.Duration) {
-	req := &dns.Msg{}
-	req.SetQuestion(".", dns.TypeNS)
-	req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
+// Probe through the same pooled transport, bootstrap and TLS config as real queries do
+func (uh *UpstreamHost) wireFormatSend(proto string) (error, time.Duration) {
+	var msg *dns.Msg
+	var err error
+	req := uh.probe.newMsg(uh.transport.recursionDesired)
+	// rtt stands for Round Trip Time
 	t := time.Now()
-	// rtt stands for Round Trip Time, it may 0 if Exchange() failed
-	msg, rtt, err := uh.c.Exchange(req, uh.addr)
-	if err != nil && rtt == 0 {
-		rtt = time.Since(t)
+	for {
+		msg, err = uh.wireFormatExchange(proto, req, dns.MinMsgSize, uh.bootstrap, uh.noIPv6, uh.hcTimeout)
+		if err == errCachedConnClosed {
+			// Remote side closed conn, retry for another connection
+			continue
+		}
+		break
+	}
+	rtt := time.Since(t)
+	if err == nil {
+		return uh.probe.verify(msg), rtt
 	}
 	// If we got a header, we're alright, basically only care about I/O errors 'n stuff.
-	if err != nil && msg != nil {
+	if msg != nil {
 		// Silly check, something sane came back.
 		if msg.Response || msg.Opcode == dns.OpcodeQuery {
 			log.Warningf("hc: Correct DNS %v malformed response  err: %v msg: %v", uh.Name(), err, msg)
 			err = nil
 		}
 	}
+	if err != nil && uh.proto == "dns" && uh.hcTcp {
+		err = fmt.Errorf("%v: %v", proto, err)
+	}
 	return err, rtt
 }
 
+// hcProbe describes the health check query and what a healthy reply looks like
+type hcProbe struct {
+	name  string // FQDN of the probe question
+	qtype uint16
+	rcode int // Expected rcode, -1 for any
+
+	requireAnswer bool   // Answer section must not be empty
+	answerNet     string // If not empty, A/AAAA in answer section must be inside this datahub netlist tag
+}
+
+func newHcProbe() *hcProbe {
+	return &hcProbe{
+		name:  ".",
+		qtype: dns.TypeNS,
+		rcode: -1,
+	}
+}
+
+func (p *hcProbe) String() string {
+	if p == nil {
+		return newHcProbe().String()
+	}
+	rcode := "any"
+	if p.rcode >= 0 {
+		rcode = dns.RcodeToString[p.rcode]
+	}
+	return fmt.Sprintf("%v %v rcode:%v answer:%v answer_net:%q",
+		p.name, dns.TypeToString[p.qtype], rcode, p.requireAnswer, p.answerNet)
+}
+
+func (p *hcProbe) newMsg(recursionDesired bool) *dns.Msg {
+	if p == nil {
+		p = newHcProbe()
+	}
+	req := &dns.Msg{}
+	req.SetQuestion(p.name, p.qtype)
+	req.MsgHdr.RecursionDesired = recursionDesired
+	return req
+}
+
+// Return nil if reply meets the probe expectations
+func (p *hcProbe) verify(reply *dns.Msg) error {
+	if p == nil || reply == nil {
+		return nil
+	}
+
+	if p.rcode >= 0 && reply.Rcode != p.rcode {
+		return fmt.Errorf("probe %v expected rcode %v, got %v",
+			p.name, dns.RcodeToString[p.rcode], dns.RcodeToString[reply.Rcode])
+	}
+
+	if p.requireAnswer && len(reply.Answer) == 0 {
+		return fmt.Errorf("probe %v expected non-empty answer", p.name)
+	}
+
+	if p.answerNet == "" {
+		return nil
+	}
+	if hubPlugin == nil {
+		return fmt.Errorf("probe %v: hubPlugin not enable", p.name)
+	}
+	found := false
+	for _, rr := range reply.Answer {
+		var ip string
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		default:
+			continue
+		}
+		found = true
+		ns, err := netutils.ParseIpNet(ip)
+		if err != nil {
+			return err
+		}
+		if !hubPlugin.MixMatchNet(p.answerNet, ns) {
+			return fmt.Errorf("probe %v answer %v not in %q", p.name, ip, p.answerNet)
+		}
+	}
+	if !found {
+		return fmt.Errorf("probe %v expected A/AAAA answer in %q", p.name, p.answerNet)
+	}
+	return nil
+}
+
 // UpstreamHostPool is an array of upstream DNS servers
 type UpstreamHostPool []*UpstreamHost
 
-// Down checks whether the upstream host is down or not
-// Down will try to use uh.downFunc first, and will fallback
-// 	to some default criteria if necessary.
+func (p UpstreamHostPool) withTag(tag string) UpstreamHostPool {
+	var pool UpstreamHostPool
+	for _, host := range p {
+		if host.tag == tag {
+			pool = append(pool, host)
+		}
+	}
+	return pool
+}
+
+// Down checks whether the host is down, it's a pure read since it's called on every selection
+//	transitions are emitted by updateState()
 func (uh *UpstreamHost) Down() bool {
 	if uh.downFunc == nil {
-		log.Warningf("Upstream host %v have no downFunc, fallback to default", uh.Name())
 		return atomic.LoadInt32(&uh.fails) > 0
 	}
-
-	down := uh.downFunc(uh)
-	if down {
-		log.Debugf("%v marked as down...", uh.Name())
-		HealthCheckAllDownCount.WithLabelValues(uh.Name()).Inc()
-	}
-	return down
+	return uh.downFunc(uh)
 }
 
 type HealthCheck struct {
@@ -564,6 +779,15 @@ type HealthCheck struct {
 
 	maxFails      int32         // Maximum fail count considered as down
 	checkInterval time.Duration // Health check interval
+	probe         *hcProbe      // Health check query and its expectations
+	timeout       time.Duration // Timeout of a single health check exchange
+	probeTcp      bool          // Probe dns:// hosts over TCP as well as UDP
+	canaries      []*hcCanary   // Poisoning detection domains
+	checkJitter   float64       // Randomize each health check interval by this fraction
+	maxBackoff    time.Duration // Cap of exponential backoff interval for down hosts
+
+	outlier *outlierDetection // Passive outlier detection, nil if disabled
+	hooks   *stateHooks       // Health state transition hooks, nil if disabled
 
 	// A global transport since Caddy doesn't support over nested blocks
 	transport *Transport
@@ -571,14 +795,39 @@ type HealthCheck struct {
 
 func (hc *HealthCheck) Start() {
 	if hc.checkInterval != 0 {
+		for _, host := range hc.hosts {
+			hc.wg.Add(1)
+			go func(host *UpstreamHost) {
+				defer hc.wg.Done()
+				hc.healthCheckWorker(host)
+			}(host)
+		}
+	}
+
+	if hc.hooks != nil {
+		hc.wg.Add(1)
+		go func() {
+			defer hc.wg.Done()
+			hc.hooks.eventWorker(hc.stop)
+		}()
+	}
+
+	hc.wg.Add(1)
+	go func() {
+		defer hc.wg.Done()
+		hc.stateWorker()
+	}()
+
+	if hc.outlier != nil {
 		hc.wg.Add(1)
 		go func() {
 			defer hc.wg.Done()
-			hc.healthCheckWorker()
+			hc.outlierWorker()
 		}()
 	}
 
 	for _, host := range hc.hosts {
+		host.resetState()
 		host.transport.Start()
 	}
 }
@@ -592,36 +841,81 @@ func (hc *HealthCheck) Stop() {
 	}
 }
 
-func (hc *HealthCheck) healthCheck() {
-	for _, host := range hc.hosts {
-		go host.Check()
+// Each host is checked on its own schedule, so probes are spread over the interval
+//	instead of firing all at once, down hosts back off exponentially up to hc.maxBackoff
+func (hc *HealthCheck) healthCheckWorker(host *UpstreamHost) {
+	// Initial health check is delayed randomly within one interval
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(hc.checkInterval))))
+	defer timer.Stop()
+
+	backoff := 0
+	for {
+		select {
+		case <-timer.C:
+			if err := host.Check(); err != nil && host.Down() {
+				backoff++
+			} else {
+				backoff = 0
+			}
+			timer.Reset(hc.nextCheckDelay(backoff))
+		case <-hc.stop:
+			return
+		}
 	}
 }
 
-func (hc *HealthCheck) healthCheckWorker() {
-	// Kick off initial health check immediately
-	hc.healthCheck()
-
-	ticker := time.NewTicker(hc.checkInterval)
+// Periodically sweep state of all hosts, so that time-based recoveries(i.e. ejection ends) are emitted
+//	without waiting for the next health check or exchange
+func (hc *HealthCheck) stateWorker() {
+	ticker := time.NewTicker(stateSweepInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			hc.healthCheck()
+			for _, host := range hc.hosts {
+				host.updateState()
+			}
 		case <-hc.stop:
 			return
 		}
 	}
 }
 
+// Return delay before next health check, backoff is count of consecutive failures while down
+func (hc *HealthCheck) nextCheckDelay(backoff int) time.Duration {
+	d := hc.checkInterval
+	for i := 0; i < backoff && d < hc.maxBackoff; i++ {
+		d *= 2
+	}
+	if backoff > 0 && d > hc.maxBackoff && hc.maxBackoff > hc.checkInterval {
+		d = hc.maxBackoff
+	}
+	if hc.checkJitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * hc.checkJitter * float64(d))
+	}
+	return d
+}
+
 func (hc *HealthCheck) Select() *UpstreamHost {
 	return hc.SelectByTag("")
 }
 
-// Select an upstream host based on the policy and the health check result
+// Select an upstream host of the tag based on the policy and the health check result
 // Taken from proxy/healthcheck/healthcheck.go with modification
+//	nil is returned if no host of the tag is available, callers decide whether to fall back to Select()
 func (hc *HealthCheck) SelectByTag(tag string) *UpstreamHost {
 	pool := hc.hosts
+	if tag != "" {
+		// Only hosts of the tag are considered, spray included
+		pool = pool.withTag(tag)
+		if len(pool) == 0 {
+			return nil
+		}
+	}
 	if len(pool) == 1 {
+		if pool[0].Drained() {
+			return nil
+		}
 		if pool[0].Down() && hc.spray == nil {
 			return nil
 		}
@@ -630,7 +924,7 @@ func (hc *HealthCheck) SelectByTag(tag string) *UpstreamHost {
 
 	allDown := true
 	for _, host := range pool {
-		if !host.Down() {
+		if !unavailable(host) {
 			allDown = false
 			break
 		}
@@ -1,6 +1,7 @@
 package metadnsq
 
 import (
+	"crypto/tls"
 	"fmt"
 	"strings"
 	"testing"
@@ -73,16 +74,103 @@ func TestSend(t *testing.T) {
 
 	for i, test := range tests {
 		uh := &UpstreamHost{
-			addr: test.addr,
-			c: &dns.Client{
-				Net:     test.proto,
-				Timeout: test.timeout,
-			},
+			addr:      test.addr,
+			proto:     test.proto,
+			hcTimeout: test.timeout,
 			transport: newTransport(),
 		}
+		if test.proto == tcpTlsProto {
+			uh.transport.tlsConfig = new(tls.Config)
+		}
+		uh.transport.Start()
 		err := uh.Check()
+		uh.transport.Stop()
 		if !test.Pass(err) {
 			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
 		}
 	}
 }
+
+// Plain DNS hosts are probed over TCP only if health_check tcp is set
+func TestCheckDnsProto(t *testing.T) {
+	// Local server only serves UDP, and replies slower than the short timeout below
+	addr := startDualServer(t, "1.2.3.4", 200*ms)
+	tests := []struct {
+		tcp         bool
+		timeout     time.Duration
+		expectedErr string
+	}{
+		{false, 1 * s, ""},
+		{true, 1 * s, "tcp: "},
+		{false, 50 * ms, "i/o timeout"},
+	}
+
+	for i, test := range tests {
+		uh := &UpstreamHost{
+			addr:      addr,
+			proto:     "dns",
+			hcTimeout: test.timeout,
+			hcTcp:     test.tcp,
+			transport: newTransport(),
+		}
+		uh.transport.Start()
+		err := uh.Check()
+		uh.transport.Stop()
+		if test.expectedErr == "" && err != nil {
+			t.Errorf("Test#%v expected health check to pass, got %v", i, err)
+		}
+		if test.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectedErr)) {
+			t.Errorf("Test#%v expected error %q, got %v", i, test.expectedErr, err)
+		}
+	}
+}
+
+func TestProbeVerify(t *testing.T) {
+	probe := newHcProbe()
+	probe.rcode = dns.RcodeSuccess
+	probe.requireAnswer = true
+
+	reply := new(dns.Msg)
+	reply.SetQuestion("www.example.com.", dns.TypeA)
+	reply.Rcode = dns.RcodeServerFailure
+	if err := probe.verify(reply); err == nil {
+		t.Errorf("Expected rcode mismatch error")
+	}
+
+	reply.Rcode = dns.RcodeSuccess
+	if err := probe.verify(reply); err == nil {
+		t.Errorf("Expected empty answer error")
+	}
+
+	rr, _ := dns.NewRR("www.example.com. 60 IN A 93.184.216.34")
+	reply.Answer = append(reply.Answer, rr)
+	if err := probe.verify(reply); err != nil {
+		t.Errorf("Expected probe to pass, got %v", err)
+	}
+}
+
+func TestNextCheckDelay(t *testing.T) {
+	hc := &HealthCheck{checkInterval: 2 * time.Second, maxBackoff: time.Minute}
+	tests := []struct {
+		backoff  int
+		expected time.Duration
+	}{
+		{0, 2 * time.Second},
+		{1, 4 * time.Second},
+		{3, 16 * time.Second},
+		{5, time.Minute},
+		{100, time.Minute},
+	}
+	for _, test := range tests {
+		if d := hc.nextCheckDelay(test.backoff); d != test.expected {
+			t.Errorf("backoff %v: expected %v, got %v", test.backoff, test.expected, d)
+		}
+	}
+
+	hc.checkJitter = 0.1
+	for i := 0; i < 100; i++ {
+		if d := hc.nextCheckDelay(0); d < 1800*time.Millisecond || d > 2200*time.Millisecond {
+			t.Fatalf("Expected jittered delay within 10%% of %v, got %v", hc.checkInterval, d)
+		}
+	}
+}
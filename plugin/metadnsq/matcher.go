@@ -2,68 +2,420 @@ package metadnsq
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/c-robinson/iplib"
 	"github.com/ca17/datahub/plugin/pkg/netutils"
 	"github.com/ca17/datahub/plugin/pkg/stringset"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
 )
 
 type subMatcher struct {
-	isValid      bool
-	name         string
-	to           string
-	clientIps    *stringset.StringSet
-	anwserIps    *stringset.StringSet
-	queryNames   *stringset.StringSet
-	anwserCNames *stringset.StringSet
-	forceEcs     string
-	notify       string
-	nxdomain     bool
-	ipset        *stringset.StringSet
+	isValid             bool
+	index               int // Position in subMatchers
+	name                string
+	matchAll            bool // Conditions are ORed by default, ANDed if matchAll is set
+	to                  string
+	clientIps           *stringset.StringSet
+	anwserIps           *stringset.StringSet
+	queryNames          *stringset.StringSet
+	anwserCNames        *stringset.StringSet
+	queryNamePatterns   *namePatterns // Inline patterns along with queryNames tags
+	anwserCNamePatterns *namePatterns // Inline patterns along with anwserCNames tags
+
+	// Negated conditions, a value matches only if it's in none of them
+	nonClientIps           *stringset.StringSet
+	nonAnwserIps           *stringset.StringSet
+	nonQueryNames          *stringset.StringSet
+	nonAnwserCNames        *stringset.StringSet
+	nonQueryNamePatterns   *namePatterns
+	nonAnwserCNamePatterns *namePatterns
+
+	qtypes    map[uint16]struct{} // Query types to match, empty for all
+	nonQtypes map[uint16]struct{} // Query types never match
+	schedules []*schedule         // Time windows the matcher is active, always active if empty
+	scheduled sync.Map            // Server -> *int32, last active state reported to MatcherScheduleActive
+
+	// Serving context conditions, see: serving.go
+	servers       map[string]struct{} // Server blocks, i.e. dns://:53
+	nonServers    map[string]struct{}
+	transports    map[string]struct{} // Client transports, i.e. udp, tls
+	nonTransports map[string]struct{}
+	listens       []*listenAddr // Local listen addresses
+	nonListens    []*listenAddr
+
+	forceEcs    string
+	notify      string
+	block       *blockAction  // Block response, see: block.go
+	answer      *staticAnswer // Local response, see: answer.go
+	ttl         ttlRewrite    // Overrides block level TTL rewriting, see: ttl.go
+	strip       recordStrip   // Records stripped from responses, see: strip.go
+	aaaaNodata  bool          // Answer AAAA queries with NODATA
+	dropRecords bool          // Drop A/AAAA records matching anwser_ips only
+	reroute     string        // Resolve again through hosts of the tag in answer phase
+	ipset       *stringset.StringSet
 }
 
 func newSubMatcher() *subMatcher {
 	return &subMatcher{
-		clientIps:    stringset.New(),
-		anwserIps:    stringset.New(),
-		queryNames:   stringset.New(),
-		anwserCNames: stringset.New(),
-		ipset:        stringset.New(),
+		clientIps:              stringset.New(),
+		anwserIps:              stringset.New(),
+		queryNames:             stringset.New(),
+		anwserCNames:           stringset.New(),
+		queryNamePatterns:      newNamePatterns(),
+		anwserCNamePatterns:    newNamePatterns(),
+		nonClientIps:           stringset.New(),
+		nonAnwserIps:           stringset.New(),
+		nonQueryNames:          stringset.New(),
+		nonAnwserCNames:        stringset.New(),
+		nonQueryNamePatterns:   newNamePatterns(),
+		nonAnwserCNamePatterns: newNamePatterns(),
+		qtypes:                 make(map[uint16]struct{}),
+		nonQtypes:              make(map[uint16]struct{}),
+		servers:                make(map[string]struct{}),
+		nonServers:             make(map[string]struct{}),
+		transports:             make(map[string]struct{}),
+		nonTransports:          make(map[string]struct{}),
+		ipset:                  stringset.New(),
+		block:                  newBlockAction(),
+		answer:                 newStaticAnswer(),
 	}
 }
 
 func (m *subMatcher) String() string {
-	return fmt.Sprintf("submatch >> to:%s clientIps:%s qname:%s anwserIps:%s cname:%s notify:%s ecs:%s ipset:%s nxdomain:%s",
+	return fmt.Sprintf("submatch >> mode:%s to:%s clientIps:%s qname:%s qtypes:%s schedules:%s serving:%s anwserIps:%s cname:%s notify:%s ecs:%s ipset:%s block:%s answer:%s ttl:%s strip:%s aaaa_nodata:%s drop_records:%s reroute:%s",
+		m.mode(),
 		m.to,
-		m.clientIps,
-		m.queryNames.String(),
-		m.anwserIps.String(),
-		m.anwserCNames.String(),
+		joinNonEmpty(m.clientIps.String(), negatedString(m.nonClientIps, nil)),
+		joinNonEmpty(m.queryNames.String(), m.queryNamePatterns.String(), negatedString(m.nonQueryNames, m.nonQueryNamePatterns)),
+		m.qtypesString(),
+		m.schedules,
+		m.servingString(),
+		joinNonEmpty(m.anwserIps.String(), negatedString(m.nonAnwserIps, nil)),
+		joinNonEmpty(m.anwserCNames.String(), m.anwserCNamePatterns.String(), negatedString(m.nonAnwserCNames, m.nonAnwserCNamePatterns)),
 		m.forceEcs,
 		m.notify,
 		m.ipset.String(),
-		strconv.FormatBool(m.nxdomain),
+		m.block,
+		m.answer,
+		m.ttl,
+		m.strip,
+		strconv.FormatBool(m.aaaaNodata),
+		strconv.FormatBool(m.dropRecords),
+		m.reroute,
 	)
 }
 
+// Matcher name or its index if unnamed, used as metrics label
+func (m *subMatcher) label() string {
+	if m.name != "" {
+		return m.name
+	}
+	return strconv.Itoa(m.index)
+}
+
+func (m *subMatcher) mode() string {
+	if m.matchAll {
+		return matchModeAll
+	}
+	return matchModeAny
+}
+
+func (m *subMatcher) qtypesString() string {
+	types := make([]string, 0, len(m.qtypes)+len(m.nonQtypes))
+	for t := range m.qtypes {
+		types = append(types, dns.TypeToString[t])
+	}
+	for t := range m.nonQtypes {
+		types = append(types, "!"+dns.TypeToString[t])
+	}
+	sort.Strings(types)
+	return strings.Join(types, ",")
+}
+
+// Request attributes matched against matcher conditions
+type matchState struct {
+	name     string    // Query name without trailing dot
+	qtype    uint16    // Query type
+	clientIP string    // Client IP, empty if unknown
+	client   iplib.Net // Client IP, nil if it can't be parsed
+	now      time.Time // Time of the query, evaluated against schedules
+
+	server    string // Server block the request arrived, see: metrics.WithServer()
+	transport string // Client transport, see: requestTransport()
+	localIP   net.IP
+	localPort string
+
+	hostTag string // Tag of the host the reply is from, see: reroute
+}
+
+// Client IP is resolved by reloadableUpstream.clientIP(), empty if unknown
+func newMatchState(state *request.Request, server, ip string) *matchState {
+	name := state.Name()
+	if len(name) > 1 {
+		name = removeTrailingDot(name)
+	}
+	s := &matchState{
+		name:      name,
+		qtype:     state.QType(),
+		clientIP:  ip,
+		now:       time.Now(),
+		server:    server,
+		transport: requestTransport(server, state),
+		localIP:   net.ParseIP(state.LocalIP()),
+		localPort: state.LocalPort(),
+	}
+	if ns, err := netutils.ParseIpNet(ip); ip != "" && err == nil {
+		s.client = ns
+	}
+	return s
+}
+
+func isEmptySet(s *stringset.StringSet) bool {
+	return len(s.Slice()) == 0
+}
+
+func joinNonEmpty(strs ...string) string {
+	nonEmpty := make([]string, 0, len(strs))
+	for _, s := range strs {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
+
+// Return negated tags and patterns each prefixed with '!'
+func negatedString(tags *stringset.StringSet, patterns *namePatterns) string {
+	var negated []string
+	for _, tag := range tags.Slice() {
+		negated = append(negated, "!"+tag)
+	}
+	if patterns != nil && patterns.Len() != 0 {
+		for _, p := range strings.Split(patterns.String(), ",") {
+			negated = append(negated, "!"+p)
+		}
+	}
+	sort.Strings(negated)
+	return strings.Join(negated, ",")
+}
+
+// Split condition arguments into positive ones and negated ones with '!' stripped
+func splitNegated(args []string) ([]string, []string, error) {
+	var pos, neg []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "!") {
+			pos = append(pos, arg)
+			continue
+		}
+		if arg = arg[1:]; arg == "" {
+			return nil, nil, fmt.Errorf("empty negated condition")
+		}
+		neg = append(neg, arg)
+	}
+	return pos, neg, nil
+}
+
+func (m *subMatcher) hasQueryConds() bool {
+	return m.hasQueryNames() || m.hasClientIps() || m.hasGates()
+}
+
+// Gates are qtypes, schedules and serving context conditions, which restrict a matcher in both modes
+func (m *subMatcher) hasGates() bool {
+	return len(m.qtypes) != 0 || len(m.nonQtypes) != 0 || len(m.schedules) != 0 ||
+		len(m.servers) != 0 || len(m.nonServers) != 0 ||
+		len(m.transports) != 0 || len(m.nonTransports) != 0 ||
+		len(m.listens) != 0 || len(m.nonListens) != 0
+}
+
+// Return true if gates are the only conditions, such matcher matches by gates alone in any mode
+func (m *subMatcher) gatesOnly() bool {
+	return m.hasGates() && !m.hasQueryNames() && !m.hasClientIps() && !m.hasAnwserConds()
+}
+
+func (m *subMatcher) hasAnwserConds() bool {
+	return m.hasAnwserIps() || m.hasAnwserCNames()
+}
+
+func (m *subMatcher) hasClientIps() bool {
+	return !isEmptySet(m.clientIps) || !isEmptySet(m.nonClientIps)
+}
+
+func (m *subMatcher) hasAnwserIps() bool {
+	return !isEmptySet(m.anwserIps) || !isEmptySet(m.nonAnwserIps)
+}
+
+func (m *subMatcher) hasQueryNames() bool {
+	return !isEmptySet(m.queryNames) || m.queryNamePatterns.Len() != 0 ||
+		!isEmptySet(m.nonQueryNames) || m.nonQueryNamePatterns.Len() != 0
+}
+
+func (m *subMatcher) hasAnwserCNames() bool {
+	return !isEmptySet(m.anwserCNames) || m.anwserCNamePatterns.Len() != 0 ||
+		!isEmptySet(m.nonAnwserCNames) || m.nonAnwserCNamePatterns.Len() != 0
+}
+
+// Return true if every configured query phase condition matched, used in all mode
+func (m *subMatcher) matchQueryConds(s *matchState) bool {
+	if !m.matchGates(s) {
+		return false
+	}
+	if m.hasQueryNames() && !m.matchQueryName(s.name) {
+		return false
+	}
+	if m.hasClientIps() && (s.client == nil || !m.matchClientIp(s.client)) {
+		return false
+	}
+	return true
+}
+
+// Return true if every configured answer phase condition is met by at least one record, used in all mode
+func (m *subMatcher) matchAnwserConds(reply *dns.Msg) bool {
+	ipMatched, cnameMatched := !m.hasAnwserIps(), !m.hasAnwserCNames()
+	for _, rr := range reply.Answer {
+		var ip string
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		case *dns.CNAME:
+			if !cnameMatched && m.matchAnwserCname(rr.Target) {
+				cnameMatched = true
+			}
+			continue
+		default:
+			continue
+		}
+		if ipMatched {
+			continue
+		}
+		if ns, err := netutils.ParseIpNet(ip); err == nil && m.matchAnwserIp(ns) {
+			ipMatched = true
+		}
+	}
+	return ipMatched && cnameMatched
+}
+
+func (m *subMatcher) matchGates(s *matchState) bool {
+	return m.matchQtype(s.qtype) && m.matchServer(s.server) && m.matchTransport(s.transport) &&
+		m.matchListen(s.localIP, s.localPort) && m.matchSchedule(s.server, s.now)
+}
+
+func (m *subMatcher) matchQtype(qtype uint16) bool {
+	if _, ok := m.nonQtypes[qtype]; ok {
+		return false
+	}
+	if len(m.qtypes) == 0 {
+		return true
+	}
+	_, ok := m.qtypes[qtype]
+	return ok
+}
+
+// Return true if any of the schedules is active
+func (m *subMatcher) matchSchedule(server string, now time.Time) bool {
+	if len(m.schedules) == 0 {
+		return true
+	}
+	active := false
+	for _, sc := range m.schedules {
+		if sc.active(now) {
+			active = true
+			break
+		}
+	}
+	m.observeSchedule(server, active)
+	return active
+}
+
+// Set the schedule gauge of the server only when the active state flips, return true if it's set
+func (m *subMatcher) observeSchedule(server string, active bool) bool {
+	var v int32
+	if active {
+		v = 1
+	}
+	if p, ok := m.scheduled.Load(server); ok {
+		if atomic.SwapInt32(p.(*int32), v) == v {
+			return false
+		}
+	} else if p, loaded := m.scheduled.LoadOrStore(server, &v); loaded && atomic.SwapInt32(p.(*int32), v) == v {
+		return false
+	}
+	MatcherScheduleActive.WithLabelValues(server, m.label()).Set(float64(v))
+	return true
+}
+
+// Count a hit for each action fired, a hit without any action is counted as none
+func (m *subMatcher) observeHit(server, phase string, actions []string) {
+	if len(actions) == 0 {
+		actions = []string{matchActionNone}
+	}
+	for _, action := range actions {
+		MatcherHitCount.WithLabelValues(server, m.label(), phase, action).Inc()
+	}
+}
+
+// Count hits of scheduled matchers, phase is either query or answer
+func (m *subMatcher) observeScheduleHit(server, phase string) {
+	if len(m.schedules) != 0 {
+		MatcherScheduleHitCount.WithLabelValues(server, m.label(), phase).Inc()
+	}
+}
+
+// Conditions with negated entries match if the value is in none of the negated tags or patterns,
+//	and in any of the positive ones if there is any, conditions not configured never match
 func (m *subMatcher) matchQueryName(name string) bool {
-	return hubPlugin.MixMatchTags(m.queryNames.Slice(), name, false)
+	if !m.hasQueryNames() || matchNameTags(m.nonQueryNames, m.nonQueryNamePatterns, name) {
+		return false
+	}
+	if isEmptySet(m.queryNames) && m.queryNamePatterns.Len() == 0 {
+		return true
+	}
+	return matchNameTags(m.queryNames, m.queryNamePatterns, name)
 }
 
 func (m *subMatcher) matchAnwserCname(name string) bool {
-	return hubPlugin.MixMatchTags(m.anwserCNames.Slice(), name, false)
+	if !m.hasAnwserCNames() || matchNameTags(m.nonAnwserCNames, m.nonAnwserCNamePatterns, name) {
+		return false
+	}
+	if isEmptySet(m.anwserCNames) && m.anwserCNamePatterns.Len() == 0 {
+		return true
+	}
+	return matchNameTags(m.anwserCNames, m.anwserCNamePatterns, name)
 }
 
 func (m *subMatcher) matchClientIp(ns iplib.Net) bool {
-	return m.clientIps.MatchFnFirst(func(src string) bool {
-		return hubPlugin.MixMatchNet(src, ns)
-	})
+	if !m.hasClientIps() || matchNetTags(m.nonClientIps, ns) {
+		return false
+	}
+	return isEmptySet(m.clientIps) || matchNetTags(m.clientIps, ns)
 }
 
 func (m *subMatcher) matchAnwserIp(ns iplib.Net) bool {
-	return m.anwserIps.MatchFnFirst(func(src string) bool {
+	if !m.hasAnwserIps() || matchNetTags(m.nonAnwserIps, ns) {
+		return false
+	}
+	return isEmptySet(m.anwserIps) || matchNetTags(m.anwserIps, ns)
+}
+
+func matchNameTags(tags *stringset.StringSet, patterns *namePatterns, name string) bool {
+	if patterns.Match(name) {
+		return true
+	}
+	slice := tags.Slice()
+	return len(slice) != 0 && hubPlugin.MixMatchTags(slice, name, false)
+}
+
+func matchNetTags(tags *stringset.StringSet, ns iplib.Net) bool {
+	return tags.MatchFnFirst(func(src string) bool {
 		return hubPlugin.MixMatchNet(src, ns)
 	})
 }
@@ -78,47 +430,67 @@ func newSubMatchers() *subMatchers {
 }
 
 func (ms *subMatchers) addSubMatcher(m *subMatcher) {
+	m.index = len(ms.matchers)
 	ms.matchers = append(ms.matchers, m)
 }
 
-func (ms *subMatchers) matchQuery(name string) *subMatcher {
+// Matchers in any mode are tried by query name first and then by client IP,
+//	matchers in all mode match if every query phase condition holds and no answer phase condition is configured
+func (ms *subMatchers) matchQuery(s *matchState) *subMatcher {
 	ms.RLock()
 	defer ms.RUnlock()
 	for _, matcher := range ms.matchers {
-		if matcher.matchQueryName(name) {
+		if matcher.matchAll {
+			if matcher.hasQueryConds() && !matcher.hasAnwserConds() && matcher.matchQueryConds(s) {
+				return matcher
+			}
+			continue
+		}
+		if !matcher.matchGates(s) {
+			continue
+		}
+		if matcher.gatesOnly() || matcher.matchQueryName(s.name) {
+			return matcher
+		}
+	}
+	if s.client == nil {
+		return nil
+	}
+	for _, matcher := range ms.matchers {
+		if !matcher.matchAll && matcher.matchGates(s) && matcher.matchClientIp(s.client) {
 			return matcher
 		}
 	}
 	return nil
 }
 
-func (ms *subMatchers) matchAnwser(name string) *subMatcher {
+func (ms *subMatchers) matchAnwser(s *matchState, name string) *subMatcher {
 	ms.RLock()
 	defer ms.RUnlock()
 	for _, matcher := range ms.matchers {
-		if matcher.matchAnwserCname(name) {
+		if !matcher.matchAll && matcher.matchGates(s) && matcher.matchAnwserCname(name) {
 			return matcher
 		}
 	}
 	return nil
 }
 
-func (ms *subMatchers) matchClientIp(ip string) *subMatcher {
-	ns, err := netutils.ParseIpNet(ip)
-	if err != nil {
-		return nil
-	}
+// Return the first all mode matcher whose query and answer phase conditions all hold
+func (ms *subMatchers) matchAllAnwser(s *matchState, reply *dns.Msg) *subMatcher {
 	ms.RLock()
 	defer ms.RUnlock()
 	for _, matcher := range ms.matchers {
-		if matcher.matchClientIp(ns) {
+		if !matcher.matchAll || !matcher.hasAnwserConds() {
+			continue
+		}
+		if matcher.matchQueryConds(s) && matcher.matchAnwserConds(reply) {
 			return matcher
 		}
 	}
 	return nil
 }
 
-func (ms *subMatchers) matchAnwserIp(ip string) *subMatcher {
+func (ms *subMatchers) matchAnwserIp(s *matchState, ip string) *subMatcher {
 	ns, err := netutils.ParseIpNet(ip)
 	if err != nil {
 		return nil
@@ -126,9 +498,29 @@ func (ms *subMatchers) matchAnwserIp(ip string) *subMatcher {
 	ms.RLock()
 	defer ms.RUnlock()
 	for _, matcher := range ms.matchers {
-		if matcher.matchAnwserIp(ns) {
+		if !matcher.matchAll && matcher.matchGates(s) && matcher.matchAnwserIp(ns) {
 			return matcher
 		}
 	}
 	return nil
 }
+
+const (
+	matchModeAny = "any"
+	matchModeAll = "all"
+
+	matchPhaseQuery  = "query"
+	matchPhaseAnswer = "answer"
+
+	matchActionNone        = "none"
+	matchActionRoute       = "route"
+	matchActionEcs         = "ecs"
+	matchActionNotify      = "notify"
+	matchActionIpset       = "ipset"
+	matchActionAnswer      = "answer"
+	matchActionTtl         = "ttl"
+	matchActionStrip       = "strip"
+	matchActionNodata      = "aaaa_nodata"
+	matchActionDropRecords = "drop_records"
+	matchActionReroute     = "reroute"
+)
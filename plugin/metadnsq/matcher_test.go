@@ -0,0 +1,246 @@
+package metadnsq
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestSetupMatcher(t *testing.T) {
+	tests := []testCase{
+		// Negative
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n mode \n } \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n mode both \n } \n }", true, "unknown mode"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n qtypes \n } \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n qtypes A FOO \n } \n }", true, "unknown query type"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n schedule mon-fri \n } \n }", true, "expected <days>"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n query_names regexp:( \n } \n }", true, "invalid regexp pattern"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n client_ips office ! \n } \n }", true, "empty negated condition"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n query_names !regexp:( \n } \n }", true, "invalid regexp pattern"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n transports udp quux \n } \n }", true, "unknown transport"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n listen :foo \n } \n }", true, "invalid port"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n servers \n } \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n answer A ::1 \n } \n }", true, "isn't an A address"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n answer_ttl -1 \n } \n }", true, "invalid ttl"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n block servfail \n } \n }", true, "unknown block mode"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n ede forged \n } \n }", true, "unknown extended error"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n max_ttl 60 \n min_ttl 300 \n } \n }", true, "greater than max_ttl"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n strip a \n } \n }", true, "unknown strip target"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n aaaa_nodata yes \n } \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n query_names ads \n drop_records \n } \n }", true, "anwser_ips is required"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n reroute \n } \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n anwser_ips !cn \n reroute t2 \n } \n }", true, "no host of tag"},
+		{"metadnsq . { to t1 1.2.3.4 \n to t2 8.8.8.8 \n matcher { \n query_names cn \n reroute t2 \n } \n }", true, "anwser_ips or anwser_cnames is required"},
+		// Positive
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n mode any \n query_names ads \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n mode all \n client_ips office \n query_names ads \n nxdomain \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n qtypes https svcb \n to t2 \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n qtypes !A !AAAA \n query_names ads \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n schedule mon-fri 09:00-18:00 Asia/Shanghai \n schedule sat 10:00-12:00 \n query_names games \n nxdomain \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n query_names ads full:a.com domain:b.com *.c.com keyword:ad regexp:^x \n anwser_cnames domain:cdn.com \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n client_ips !wjtoffice \n force_ecs \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n query_names ads \n answer A 10.0.0.1 \n answer AAAA fd00::1 \n answer_ttl 300 \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n query_names ads !domain:example.com \n anwser_ips !cn \n anwser_cnames !cdn \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n query_names gfw \n block noerror_empty \n ede censored blocked by policy \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n min_ttl 60 \n negative_ttl 30 \n matcher { \n query_names cdn \n ipset cdn \n min_ttl 600 \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n client_ips vpn \n aaaa_nodata \n strip aaaa ipv6hint ech \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n matcher { \n anwser_ips sinkhole \n drop_records \n } \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n to t2 8.8.8.8 \n matcher { \n anwser_ips !cn \n reroute t2 \n } \n }", false, ""},
+	}
+
+	runSetupTests(t, tests)
+}
+
+func TestMatchAllMode(t *testing.T) {
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n matcher { \n name office \n mode all \n nxdomain \n } \n }")
+	ms := u.subMatchers
+	if len(ms.matchers) != 1 || !ms.matchers[0].matchAll {
+		t.Fatalf("Expected a single matcher in all mode, got %v", ms.matchers)
+	}
+	// A matcher in all mode without any condition never matches
+	if m := ms.matchQuery(&matchState{name: "www.example.com", qtype: dns.TypeA}); m != nil {
+		t.Errorf("Expected no match, got %v", m)
+	}
+}
+
+func TestMatchQtype(t *testing.T) {
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n"+
+		"matcher { \n name https \n qtypes HTTPS SVCB \n to t2 \n } \n"+
+		"matcher { \n name not_a \n mode all \n qtypes !A !AAAA \n nxdomain \n } \n }")
+	ms := u.subMatchers
+
+	tests := []struct {
+		qtype    uint16
+		expected string
+	}{
+		{dns.TypeHTTPS, "https"},
+		{dns.TypeSVCB, "https"},
+		{dns.TypeA, ""},
+		{dns.TypeAAAA, ""},
+		{dns.TypeMX, "not_a"},
+	}
+	for _, test := range tests {
+		m := ms.matchQuery(&matchState{name: "www.example.com", qtype: test.qtype})
+		name := ""
+		if m != nil {
+			name = m.name
+		}
+		if name != test.expected {
+			t.Errorf("%v: expected matcher %q, got %q", dns.TypeToString[test.qtype], test.expected, name)
+		}
+	}
+}
+
+func TestMatchInlinePatterns(t *testing.T) {
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n"+
+		"matcher { \n name inline \n query_names domain:example.com \n } \n"+
+		"matcher { \n name cdn \n anwser_cnames full:edge.cdn.example.net regexp:^img[0-9]+\\.static\\. \n } \n }")
+	ms := u.subMatchers
+	if m := ms.matchQuery(&matchState{name: "www.example.com", qtype: dns.TypeA}); m == nil || m.name != "inline" {
+		t.Errorf("Expected inline matcher, got %v", m)
+	}
+	if m := ms.matchQuery(&matchState{name: "www.example.org", qtype: dns.TypeA}); m != nil {
+		t.Errorf("Expected no match, got %v", m)
+	}
+
+	for _, test := range []struct {
+		cname    string
+		expected string
+	}{
+		{"edge.cdn.example.net.", "cdn"},
+		{"img12.static.example.org.", "cdn"},
+		{"www.edge.cdn.example.net.", ""},
+		{"img.static.example.org.", ""},
+	} {
+		name := ""
+		if m := ms.matchAnwser(&matchState{qtype: dns.TypeA}, test.cname); m != nil {
+			name = m.name
+		}
+		if name != test.expected {
+			t.Errorf("CNAME %v: expected matcher %q, got %q", test.cname, test.expected, name)
+		}
+	}
+}
+
+func TestMatchNegated(t *testing.T) {
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n"+
+		"matcher { \n name except \n query_names domain:example.com !full:www.example.com \n } \n"+
+		"matcher { \n name others \n query_names !domain:example.com \n } \n }")
+	ms := u.subMatchers
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"mail.example.com", "except"},
+		{"example.com", "except"},
+		{"www.example.com", ""},
+		{"www.example.org", "others"},
+	}
+	for _, test := range tests {
+		m := ms.matchQuery(&matchState{name: test.name, qtype: dns.TypeA})
+		name := ""
+		if m != nil {
+			name = m.name
+		}
+		if name != test.expected {
+			t.Errorf("%v: expected matcher %q, got %q", test.name, test.expected, name)
+		}
+	}
+}
+
+func TestMatchAnwserReroute(t *testing.T) {
+	// Negated tags match any address without datahub
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n to t2 8.8.8.8 \n matcher { \n anwser_ips !cn \n reroute t2 \n } \n }")
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	state := &request.Request{W: &remoteWriter{remote: net.ParseIP("127.0.0.1")}, Req: req}
+	rwrite := NewResponseReverter(state.W)
+
+	// Replies without any address are never rerouted
+	if _, tag := (&MetaForward{}).matchAnwser(u, state, &matchState{qtype: dns.TypeA}, rwrite, reply); tag != "" {
+		t.Errorf("Expected no reroute for an empty reply, got %q", tag)
+	}
+
+	rr, _ := dns.NewRR("www.example.com. 60 IN A 10.0.0.1")
+	reply.Answer = append(reply.Answer, rr)
+	msg, tag := (&MetaForward{}).matchAnwser(u, state, &matchState{qtype: dns.TypeA}, rwrite, reply)
+	if tag != "t2" {
+		t.Errorf("Expected reroute to t2, got %q", tag)
+	}
+	if msg != reply || len(msg.Answer) != 1 {
+		t.Errorf("Expected the reply kept as is, got %v", msg)
+	}
+}
+
+// Start a local server answering with a CNAME to target, which resolves to ip
+func startCnameServer(t *testing.T, target, ip string) string {
+	return startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		cname, _ := dns.NewRR(req.Question[0].Name + " 60 IN CNAME " + target)
+		a, _ := dns.NewRR(target + " 60 IN A " + ip)
+		msg.Answer = append(msg.Answer, cname, a)
+		_ = w.WriteMsg(msg)
+	})
+}
+
+func TestServeDNSReroute(t *testing.T) {
+	tests := []struct {
+		t1Target      string
+		t2Target      string
+		t2Drained     bool
+		expectedRcode int
+		expectedErr   error
+		expectedIP    string
+	}{
+		// Replies of t2 are trusted since t2 is the reroute tag, remaining actions are applied
+		{"x.example.", "x.example.", false, dns.RcodeSuccess, nil, "10.0.0.2"},
+		// No available host of the reroute tag, the untrusted reply mustn't be written
+		{"x.example.", "x.example.", true, dns.RcodeServerFailure, errNoHealthy, ""},
+		// t1 and t2 reroute to each other
+		{"x.example.", "y.example.", false, dns.RcodeServerFailure, errRerouteDepth, ""},
+	}
+
+	for i, test := range tests {
+		t1 := startCnameServer(t, test.t1Target, "10.0.0.1")
+		t2 := startCnameServer(t, test.t2Target, "10.0.0.2")
+		up := mustTestUpstream(t, "metadnsq . { to t1 "+t1+" \n to t2 "+t2+" \n"+
+			"matcher { \n query_names full:www.example.com \n to t1 \n } \n"+
+			"matcher { \n anwser_cnames full:x.example \n reroute t2 \n max_ttl 30 \n } \n"+
+			"matcher { \n anwser_cnames full:y.example \n reroute t1 \n } \n }")
+		up.HealthCheck.Start()
+		t.Cleanup(up.HealthCheck.Stop)
+		up.hosts.withTag("t2")[0].SetDrained(test.t2Drained)
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		w := dnstest.NewRecorder(&remoteWriter{remote: net.ParseIP("127.0.0.1")})
+		rc, err := (&MetaForward{Upstreams: &[]Upstream{up}}).ServeDNS(context.TODO(), w, req)
+		if rc != test.expectedRcode || err != test.expectedErr {
+			t.Errorf("Test#%v: expected rcode %v error %v, got %v %v", i, test.expectedRcode, test.expectedErr, rc, err)
+			continue
+		}
+		if test.expectedIP == "" {
+			if w.Msg != nil {
+				t.Errorf("Test#%v: expected nothing written, got %v", i, w.Msg)
+			}
+			continue
+		}
+		if w.Msg == nil || len(w.Msg.Answer) != 2 {
+			t.Errorf("Test#%v: expected CNAME and A, got %v", i, w.Msg)
+			continue
+		}
+		a, ok := w.Msg.Answer[1].(*dns.A)
+		if !ok || a.A.String() != test.expectedIP || a.Hdr.Ttl != 30 {
+			t.Errorf("Test#%v: expected %v with max_ttl applied, got %v", i, test.expectedIP, w.Msg.Answer[1])
+		}
+	}
+}
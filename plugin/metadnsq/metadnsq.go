@@ -3,6 +3,7 @@ package metadnsq
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -70,29 +71,51 @@ func (r *MetaForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *d
 	}
 	upstream := upstream0.(*reloadableUpstream)
 	var rwrite = NewResponseReverter(w)
+	rwrite.ttl = upstream.ttl
+	s := newMatchState(state, server, upstream.clientIP(state))
 
 	// 请求参数匹配处理
-	qmatcher, rcode := r.matchQuery(upstream, state, rwrite)
-	if rcode != dns.RcodeSuccess {
-		return rcode, nil
+	qmatcher, local, done := r.matchQuery(upstream, state, s, rwrite)
+	if done {
+		// Nothing is written if the request is dropped
+		if local != nil {
+			_ = rwrite.WriteMsg(local)
+		}
+		return dns.RcodeSuccess, nil
 	}
 
 	log.Debugf("%q in name list, t: %v", name, t)
 
 	var reply *dns.Msg
 	var upstreamErr error
+	var tag string
+	if qmatcher != nil {
+		tag = qmatcher.to
+	}
+	reroutes := 0
 	deadline := time.Now().Add(defaultTimeout)
 	for time.Now().Before(deadline) {
 		start := time.Now()
 
 		var host *UpstreamHost
 
-		if qmatcher != nil && qmatcher.to != "" {
-			host = upstream.SelectByTag(qmatcher.to)
-		}
+		if tag == "" && upstream.dual != nil {
+			// Explicit routes and reroutes bypass dual resolution
+			host, reply, upstreamErr = r.dualExchange(ctx, upstream, state, server)
+		} else {
+			if tag != "" {
+				host = upstream.SelectByTag(tag)
+			}
 
-		if host == nil {
-			host = upstream.Select()
+			// Rerouted requests never fall back to hosts of other tags, which may give the untrusted reply again
+			if host == nil && reroutes == 0 {
+				host = upstream.Select()
+			}
+
+			if host != nil {
+				log.Debugf("Upstream host %v is selected", host.Name())
+				reply, _, upstreamErr = r.exchange(ctx, upstream, state, server, host)
+			}
 		}
 
 		if host == nil {
@@ -100,26 +123,7 @@ func (r *MetaForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *d
 			return dns.RcodeServerFailure, errNoHealthy
 		}
 
-		log.Debugf("Upstream host %v is selected", host.Name())
-
-		for {
-			t := time.Now()
-			reply, upstreamErr = host.Exchange(ctx, state, upstream.bootstrap, upstream.noIPv6)
-			log.Debugf("rtt: %v", time.Since(t))
-			if upstreamErr == errCachedConnClosed {
-				// [sic] Remote side closed conn, can only happen with TCP.
-				// Retry for another connection
-				log.Debugf("%v: %v", upstreamErr, host.Name())
-				continue
-			}
-			break
-		}
-
 		if upstreamErr != nil {
-			if upstream.maxFails != 0 {
-				log.Warningf("Exchange() failed  error: %v", upstreamErr)
-				healthCheck(upstream, host)
-			}
 			continue
 		}
 
@@ -132,13 +136,6 @@ func (r *MetaForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *d
 			return dns.RcodeSuccess, nil
 		}
 
-		// 响应参数匹配处理
-		rcode := r.matchAnwser(upstream, state, reply)
-		if rcode != dns.RcodeSuccess {
-			return rcode, nil
-		}
-		_ = rwrite.WriteMsg(reply)
-
 		RequestDuration.WithLabelValues(server, host.Name()).Observe(float64(time.Since(start).Milliseconds()))
 		RequestCount.WithLabelValues(server, host.Name()).Inc()
 
@@ -147,6 +144,33 @@ func (r *MetaForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *d
 			rc = strconv.Itoa(reply.Rcode)
 		}
 		RcodeCount.WithLabelValues(server, host.Name(), rc).Inc()
+
+		// 响应参数匹配处理
+		var rerouteTag string
+		s.hostTag = host.tag
+		reply, rerouteTag = r.matchAnwser(upstream, state, s, rwrite, reply)
+		if rerouteTag != "" {
+			// Discard the untrusted reply and resolve again through hosts of another tag
+			//	it's never written to the client, even if the reroute isn't possible
+			if reroutes >= maxRerouteDepth {
+				log.Warningf("%q: reroute to %v exceeds max depth %v", name, rerouteTag, maxRerouteDepth)
+				return dns.RcodeServerFailure, errRerouteDepth
+			}
+			if upstream.SelectByTag(rerouteTag) == nil {
+				log.Warningf("%q: no available host of tag %v to reroute", name, rerouteTag)
+				return dns.RcodeServerFailure, errNoHealthy
+			}
+			log.Debugf("%q: reroute from %v to tag %v", name, host.Name(), rerouteTag)
+			reroutes++
+			tag = rerouteTag
+			upstreamErr = errRerouteTimeout
+			continue
+		}
+		// Nothing is written if the reply is dropped
+		if reply == nil {
+			return dns.RcodeSuccess, nil
+		}
+		_ = rwrite.WriteMsg(reply)
 		return dns.RcodeSuccess, nil
 	}
 
@@ -156,36 +180,100 @@ func (r *MetaForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *d
 	return dns.RcodeServerFailure, upstreamErr
 }
 
-func (r *MetaForward) matchQuery(upstream *reloadableUpstream, state *request.Request, rwrite *ResponseReverter) (*subMatcher, int) {
-	var name, ip = state.Name(), state.IP()
-	if len(name) > 1 {
-		name = removeTrailingDot(name)
-	}
-	qmatcher := upstream.subMatchers.matchQuery(name)
-	if qmatcher == nil {
-		qmatcher = upstream.subMatchers.matchClientIp(ip)
+// Exchange with host, failed exchanges are counted towards max_fails
+//	bogus is true if the reply was converted by bogus_nxdomain, thus it shouldn't be trusted
+func (r *MetaForward) exchange(ctx context.Context, upstream *reloadableUpstream, state *request.Request, server string, host *UpstreamHost) (reply *dns.Msg, bogus bool, err error) {
+	for {
+		t := time.Now()
+		reply, err = host.Exchange(ctx, state, upstream.bootstrap, upstream.noIPv6)
+		rtt := time.Since(t)
+		log.Debugf("rtt: %v", rtt)
+		if err == errCachedConnClosed {
+			// [sic] Remote side closed conn, can only happen with TCP.
+			// Retry for another connection
+			log.Debugf("%v: %v", err, host.Name())
+			continue
+		}
+		// Bogus NXDOMAIN is a soft failure, the converted reply is still returned
+		//	but the host is penalized like a failed exchange
+		outcomeErr := err
+		if err == nil {
+			if outcomeErr = upstream.bogusNxdomain.check(reply); outcomeErr != nil {
+				host.observeBogusNxdomain(server, outcomeErr)
+				bogus = true
+			}
+		}
+		host.recordOutcome(rtt, reply, outcomeErr)
+
+		if outcomeErr != nil && upstream.maxFails != 0 {
+			log.Warningf("Exchange() failed  error: %v", outcomeErr)
+			healthCheck(upstream, host, outcomeErr)
+		}
+		return reply, bogus, err
 	}
+}
+
+// Return the matched matcher, a local response if any, and true if the request shouldn't be forwarded
+// The local response is nil if the request is dropped
+func (r *MetaForward) matchQuery(upstream *reloadableUpstream, state *request.Request, s *matchState, rwrite *ResponseReverter) (*subMatcher, *dns.Msg, bool) {
+	ip := s.clientIP
+	qmatcher := upstream.subMatchers.matchQuery(s)
 	if qmatcher != nil {
+		var actions []string
+		defer func() {
+			qmatcher.observeHit(s.server, matchPhaseQuery, actions)
+		}()
+		qmatcher.observeScheduleHit(s.server, matchPhaseQuery)
 
 		if upstream.debug {
-			log.Infof("matchQuery %s", qmatcher.String())
+			log.Infof("matchQuery client: %s %s", ip, qmatcher.String())
 		}
 
 		if qmatcher.notify != "" {
 			hubPlugin.NotifyMessage(qmatcher.notify, state)
+			actions = append(actions, matchActionNotify)
 		}
 
-		qmatcher.ipset.ForEach(func(sname string) {
-			ipsetAddIPByName(upstream, state.Req, sname)
-		})
+		if !qmatcher.ttl.isEmpty() {
+			rwrite.ttl = rwrite.ttl.merge(qmatcher.ttl)
+			actions = append(actions, matchActionTtl)
+		}
 
-		// 匹配 NXDOMAIN
-		if qmatcher.nxdomain {
-			return nil, dns.RcodeNameError
+		if !qmatcher.strip.isEmpty() {
+			rwrite.strip = rwrite.strip.merge(qmatcher.strip)
+			actions = append(actions, matchActionStrip)
+		}
+
+		if !isEmptySet(qmatcher.ipset) {
+			qmatcher.ipset.ForEach(func(sname string) {
+				ipsetAddIPByName(upstream, state.Req, sname)
+			})
+			actions = append(actions, matchActionIpset)
+		}
+
+		// 匹配屏蔽: NXDOMAIN, REFUSED, NODATA 或丢弃
+		if qmatcher.block.enabled() {
+			actions = append(actions, qmatcher.block.mode)
+			return qmatcher, qmatcher.blockReply(state.Req), true
+		}
+
+		if qmatcher.aaaaNodata && s.qtype == dns.TypeAAAA {
+			actions = append(actions, matchActionNodata)
+			return qmatcher, qmatcher.nodataReply(state.Req), true
+		}
+
+		// Sinkhole with static answers
+		if !qmatcher.answer.isEmpty() {
+			actions = append(actions, matchActionAnswer)
+			return qmatcher, qmatcher.answer.reply(state.Req), true
+		}
+
+		if qmatcher.to != "" {
+			actions = append(actions, matchActionRoute)
 		}
 
 		// set ecs
-		if qmatcher.forceEcs != "" {
+		if qmatcher.forceEcs != "" && ip != "" {
 			ecsip := hubPlugin.MatchEcs(qmatcher.forceEcs, ip)
 			if ecsip != nil {
 				var qHasECS = getMsgECS(state.Req) != nil
@@ -201,67 +289,158 @@ func (r *MetaForward) matchQuery(upstream *reloadableUpstream, state *request.Re
 				if ecs != nil {
 					setECS(state.Req, ecs)
 					rwrite.removeEcs = qHasECS
+					actions = append(actions, matchActionEcs)
 				}
 			}
 		}
 	}
-	return qmatcher, 0
+	return qmatcher, nil, false
 }
 
-func (r *MetaForward) matchAnwser(upstream *reloadableUpstream, state *request.Request, reply *dns.Msg) int {
-	for _, rr := range reply.Answer {
+// Return the reply to be written, nil if it should be dropped
+// Reroute tag is returned if the reply should be resolved again through another tag
+func (r *MetaForward) matchAnwser(upstream *reloadableUpstream, state *request.Request, s *matchState, rwrite *ResponseReverter, reply *dns.Msg) (*dns.Msg, string) {
+	// Matchers with drop_records filter the whole answer section at once
+	var dropped map[*subMatcher]struct{}
+	var seen map[dns.RR]struct{} // Records evaluated before the answer section was replaced
+	for i := 0; i < len(reply.Answer); i++ {
+		rr := reply.Answer[i]
+		if _, ok := seen[rr]; ok {
+			continue
+		}
 		var rmatcher *subMatcher
 		switch rr.(type) {
 		case *dns.A:
 			rra := rr.(*dns.A)
-			rmatcher = upstream.subMatchers.matchAnwserIp(rra.A.String())
+			rmatcher = upstream.subMatchers.matchAnwserIp(s, rra.A.String())
 		case *dns.AAAA:
 			rra := rr.(*dns.AAAA)
-			rmatcher = upstream.subMatchers.matchAnwserIp(rra.AAAA.String())
+			rmatcher = upstream.subMatchers.matchAnwserIp(s, rra.AAAA.String())
 		case *dns.CNAME:
 			rra := rr.(*dns.CNAME)
 			name := rra.Target
 			if len(name) > 1 {
 				name = removeTrailingDot(name)
 			}
-			rmatcher = upstream.subMatchers.matchAnwser(rra.Target)
+			rmatcher = upstream.subMatchers.matchAnwser(s, rra.Target)
 		}
 
 		if rmatcher == nil {
 			continue
 		}
-
-		if upstream.debug {
-			log.Infof("matchAnwser %s", rmatcher.String())
+		if rmatcher.dropRecords {
+			if _, ok := dropped[rmatcher]; ok {
+				continue
+			}
+			if dropped == nil {
+				dropped = make(map[*subMatcher]struct{})
+			}
+			dropped[rmatcher] = struct{}{}
 		}
 
-		if rmatcher.notify != "" {
-			hubPlugin.NotifyMessage(rmatcher.notify, state)
+		// Reply has been blocked, rerouted or replaced by the static answer
+		answer := reply.Answer
+		if msg, reroute, stop := r.applyAnwserMatcher(upstream, state, s, rwrite, reply, rmatcher); stop {
+			return msg, reroute
 		}
+		if len(reply.Answer) != len(answer) {
+			// Records were dropped, evaluate the rest against the new answer section
+			if seen == nil {
+				seen = make(map[dns.RR]struct{}, len(answer))
+			}
+			for _, rr := range answer[:i+1] {
+				seen[rr] = struct{}{}
+			}
+			i = -1
+		}
+	}
+
+	// Matchers in all mode are evaluated against the whole reply
+	if rmatcher := upstream.subMatchers.matchAllAnwser(s, reply); rmatcher != nil {
+		msg, reroute, _ := r.applyAnwserMatcher(upstream, state, s, rwrite, reply, rmatcher)
+		return msg, reroute
+	}
+	return reply, ""
+}
+
+func (r *MetaForward) applyAnwserMatcher(upstream *reloadableUpstream, state *request.Request, s *matchState, rwrite *ResponseReverter, reply *dns.Msg, rmatcher *subMatcher) (*dns.Msg, string, bool) {
+	var actions []string
+	defer func() {
+		rmatcher.observeHit(s.server, matchPhaseAnswer, actions)
+	}()
+	rmatcher.observeScheduleHit(s.server, matchPhaseAnswer)
+
+	if upstream.debug {
+		log.Infof("matchAnwser %s", rmatcher.String())
+	}
+
+	if rmatcher.notify != "" {
+		hubPlugin.NotifyMessage(rmatcher.notify, state)
+		actions = append(actions, matchActionNotify)
+	}
+
+	// Untrusted addresses are never added to ipsets
+	//	the reply is trusted if it's from the reroute tag already, remaining actions are applied instead
+	if rmatcher.reroute != "" && rmatcher.reroute != s.hostTag {
+		actions = append(actions, matchActionReroute)
+		return reply, rmatcher.reroute, true
+	}
+
+	if !rmatcher.ttl.isEmpty() {
+		rwrite.ttl = rwrite.ttl.merge(rmatcher.ttl)
+		actions = append(actions, matchActionTtl)
+	}
 
+	if !rmatcher.strip.isEmpty() {
+		rwrite.strip = rwrite.strip.merge(rmatcher.strip)
+		actions = append(actions, matchActionStrip)
+	}
+
+	if rmatcher.dropRecords && rmatcher.dropAnwserRecords(reply) != 0 {
+		actions = append(actions, matchActionDropRecords)
+	}
+
+	if !isEmptySet(rmatcher.ipset) {
 		rmatcher.ipset.ForEach(func(sname string) {
 			ipsetAddIPByName(upstream, reply, sname)
 		})
+		actions = append(actions, matchActionIpset)
+	}
 
-		if rmatcher != nil && rmatcher.nxdomain {
-			return dns.RcodeNameError
-		}
+	if rmatcher.block.enabled() {
+		actions = append(actions, rmatcher.block.mode)
+		return rmatcher.blockReply(state.Req), "", true
+	}
+
+	if rmatcher.aaaaNodata && s.qtype == dns.TypeAAAA {
+		actions = append(actions, matchActionNodata)
+		return rmatcher.nodataReply(state.Req), "", true
+	}
+
+	if !rmatcher.answer.isEmpty() {
+		rmatcher.answer.rewrite(reply)
+		actions = append(actions, matchActionAnswer)
+		return reply, "", true
 	}
-	return dns.RcodeSuccess
+	return reply, "", false
 }
 
-func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
+func healthCheck(r *reloadableUpstream, uh *UpstreamHost, err error) {
 	// Skip unnecessary health checking
 	if r.checkInterval == 0 || r.maxFails == 0 {
 		return
 	}
 
 	failTimeout := defaultFailTimeout
+	uh.setStateReason(fmt.Sprintf("exchange failed: %v", err))
 	fails := atomic.AddInt32(&uh.fails, 1)
+	uh.updateState()
 	go func(uh *UpstreamHost) {
 		time.Sleep(failTimeout)
 		// Failure count may go negative here, should be rectified by HC eventually
+		uh.setStateReason("exchange failure expired")
 		atomic.AddInt32(&uh.fails, -1)
+		uh.updateState()
 		// Kick off health check on every failureCheck failure
 		if fails%failureCheck == 0 {
 			_ = uh.Check()
@@ -300,10 +479,13 @@ func (r *MetaForward) match(server, name string) (Upstream, time.Duration) {
 var (
 	errNoHealthy        = errors.New("no healthy upstream host")
 	errCachedConnClosed = errors.New("cached connection was closed by peer")
+	errRerouteTimeout   = errors.New("timed out after reroute")
+	errRerouteDepth     = errors.New("reroute exceeds max depth")
 )
 
 const (
 	defaultTimeout     = 15 * time.Second
 	defaultFailTimeout = 2000 * time.Millisecond
 	failureCheck       = 3
+	maxRerouteDepth    = 2
 )
@@ -60,4 +60,67 @@ var (
 		Name:      "hc_all_down_count_total",
 		Help:      "Counter of the number of complete failures of the healthchecks.",
 	}, []string{"to"})
+
+	HealthCheckPoisonedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "hc_poisoned_count_total",
+		Help:      "Counter of health checks which detected poisoned canary answers.",
+	}, []string{"to", "canary"})
+
+	BogusNxdomainCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "bogus_nxdomain_count_total",
+		Help:      "Counter of replies turned into NXDOMAIN since they contain bogus_nxdomain addresses.",
+	}, []string{"server", "to"})
+
+	DualChoiceCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "dual_choice_count_total",
+		Help:      "Counter of replies chosen by dual resolution, either domestic, foreign, domestic_fallback or foreign_fallback.",
+	}, []string{"server", "choice"})
+
+	MatcherHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "matcher_hit_count_total",
+		Help:      "Counter of matcher hits per action fired, matcher is labelled by name or index if unnamed.",
+	}, []string{"server", "matcher", "phase", "action"})
+
+	MatcherScheduleActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "matcher_schedule_active",
+		Help:      "Gauge of scheduled matcher state at last evaluation, 1 for active and 0 for inactive.",
+	}, []string{"server", "matcher"})
+
+	MatcherScheduleHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "matcher_schedule_hit_count_total",
+		Help:      "Counter of requests matched by scheduled matchers.",
+	}, []string{"server", "matcher", "phase"})
+
+	OutlierEjectionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "outlier_ejection_count_total",
+		Help:      "Counter of upstream hosts ejected by passive outlier detection.",
+	}, []string{"to", "reason"})
+
+	HealthStateUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "hc_host_up",
+		Help:      "Gauge of upstream host health state, 1 for up and 0 for down.",
+	}, []string{"to", "tag"})
+
+	HealthStateTransitionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "hc_transition_count_total",
+		Help:      "Counter of upstream host health state transitions.",
+	}, []string{"to", "tag", "state"})
 )
@@ -0,0 +1,394 @@
+package metadnsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+// Passive outlier detection, inspired by Envoy
+// see: https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/outlier
+//
+// Exchange results from live traffic are recorded into a per-host sliding window,
+// hosts whose error rate, timeout rate or latency percentile stand out from their peers(hosts with the same tag)
+// are ejected for a period which grows on repeated ejection.
+// A host is never ejected if it's the last healthy one of its tag.
+type outlierDetection struct {
+	interval time.Duration // Evaluation interval
+	window   time.Duration // Sliding window of recorded samples
+
+	minHosts     int     // Minimal hosts of a tag for its hosts to be evaluated
+	minRequests  int     // Minimal samples in window for a host to be evaluated
+	errorRate    float64 // Error rate above peers average considered as outlier, 0 to disable
+	timeoutRate  float64 // Ditto. for timeouts
+	latencyPct   float64 // Latency percentile to compare with peers
+	latencyRatio float64 // Latency percentile above this multiple of peers median considered as outlier, 0 to disable
+
+	baseEjection       time.Duration
+	maxEjection        time.Duration
+	maxEjectionPercent int
+}
+
+func newOutlierDetection() *outlierDetection {
+	return &outlierDetection{
+		interval:           defaultOutlierInterval,
+		window:             defaultOutlierWindow,
+		minHosts:           defaultOutlierMinHosts,
+		minRequests:        defaultOutlierMinRequests,
+		errorRate:          0.5,
+		timeoutRate:        0.3,
+		latencyPct:         90,
+		latencyRatio:       0,
+		baseEjection:       defaultOutlierBaseEjection,
+		maxEjection:        defaultOutlierMaxEjection,
+		maxEjectionPercent: 50,
+	}
+}
+
+func (od *outlierDetection) String() string {
+	return fmt.Sprintf("interval:%v window:%v min_hosts:%v min_requests:%v error_rate:%v timeout_rate:%v latency:p%v*%v ejection:%v-%v max_ejection_percent:%v",
+		od.interval, od.window, od.minHosts, od.minRequests, od.errorRate, od.timeoutRate,
+		od.latencyPct, od.latencyRatio, od.baseEjection, od.maxEjection, od.maxEjectionPercent)
+}
+
+type outcome uint8
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeError
+	outcomeTimeout
+)
+
+type outlierSample struct {
+	at      time.Time
+	rtt     time.Duration
+	outcome outcome
+}
+
+// Per-host sliding window and ejection state
+type hostStats struct {
+	sync.Mutex
+	samples []outlierSample // Ring buffer
+	next    int
+
+	ejectedUntil time.Time
+	ejections    int // Ejection multiplier, decreases while the host behaves
+}
+
+func newHostStats() *hostStats {
+	return &hostStats{samples: make([]outlierSample, 0, maxOutlierSamples)}
+}
+
+func (hs *hostStats) record(rtt time.Duration, o outcome) {
+	s := outlierSample{at: time.Now(), rtt: rtt, outcome: o}
+	hs.Lock()
+	defer hs.Unlock()
+	if len(hs.samples) < cap(hs.samples) {
+		hs.samples = append(hs.samples, s)
+		return
+	}
+	hs.samples[hs.next] = s
+	hs.next = (hs.next + 1) % len(hs.samples)
+}
+
+func (hs *hostStats) ejected() bool {
+	hs.Lock()
+	defer hs.Unlock()
+	return time.Now().Before(hs.ejectedUntil)
+}
+
+type windowSummary struct {
+	total       int
+	errorRate   float64
+	timeoutRate float64
+	latency     time.Duration // Latency percentile of successful exchanges
+}
+
+func (hs *hostStats) summary(window time.Duration, pct float64) windowSummary {
+	since := time.Now().Add(-window)
+	var sum windowSummary
+	var errs, timeouts int
+	var rtts []time.Duration
+
+	hs.Lock()
+	for _, s := range hs.samples {
+		if s.at.Before(since) {
+			continue
+		}
+		sum.total++
+		switch s.outcome {
+		case outcomeError:
+			errs++
+		case outcomeTimeout:
+			timeouts++
+		default:
+			rtts = append(rtts, s.rtt)
+		}
+	}
+	hs.Unlock()
+
+	if sum.total == 0 {
+		return sum
+	}
+	sum.errorRate = float64(errs) / float64(sum.total)
+	sum.timeoutRate = float64(timeouts) / float64(sum.total)
+	if len(rtts) != 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		i := int(float64(len(rtts)-1) * pct / 100)
+		sum.latency = rtts[i]
+	}
+	return sum
+}
+
+// Classify the result of an exchange
+func exchangeOutcome(reply *dns.Msg, err error) outcome {
+	if err != nil {
+		var ne net.Error
+		if (errors.As(err, &ne) && ne.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+			return outcomeTimeout
+		}
+		return outcomeError
+	}
+	if reply != nil && reply.Rcode == dns.RcodeServerFailure {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// Record an exchange result, it's a no-op if outlier detection isn't enabled
+func (uh *UpstreamHost) recordOutcome(rtt time.Duration, reply *dns.Msg, err error) {
+	if uh.stats == nil {
+		return
+	}
+	uh.stats.record(rtt, exchangeOutcome(reply, err))
+}
+
+// Ejected checks whether the host is ejected by outlier detection
+func (uh *UpstreamHost) Ejected() bool {
+	return uh.stats != nil && uh.stats.ejected()
+}
+
+func (hc *HealthCheck) outlierWorker() {
+	ticker := time.NewTicker(hc.outlier.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			hc.detectOutliers()
+		case <-hc.stop:
+			return
+		}
+	}
+}
+
+func (hc *HealthCheck) detectOutliers() {
+	od := hc.outlier
+	summaries := make(map[*UpstreamHost]windowSummary, len(hc.hosts))
+	pools := make(map[string]int) // Host count of each tag
+	ejected := 0
+	for _, host := range hc.hosts {
+		summaries[host] = host.stats.summary(od.window, od.latencyPct)
+		pools[host.tag]++
+		if host.Ejected() {
+			ejected++
+		}
+	}
+
+	maxEjected := len(hc.hosts) * od.maxEjectionPercent / 100
+	if maxEjected == 0 {
+		// Always allow ejecting at least one host
+		maxEjected = 1
+	}
+
+	for _, host := range hc.hosts {
+		if host.Ejected() || pools[host.tag] < od.minHosts {
+			continue
+		}
+		sum := summaries[host]
+		reason := hc.outlierReason(host, sum, summaries)
+		hs := host.stats
+		if reason == "" {
+			hs.Lock()
+			if hs.ejections > 0 {
+				hs.ejections--
+			}
+			hs.Unlock()
+			continue
+		}
+		if ejected >= maxEjected {
+			log.Warningf("outlier: %v is an outlier(%v) but max ejection percent %v%% reached",
+				host.Name(), reason, od.maxEjectionPercent)
+			continue
+		}
+		if !hc.hasHealthyPeer(host) {
+			log.Warningf("outlier: %v is an outlier(%v) but it's the last healthy host of tag %q",
+				host.Name(), reason, host.tag)
+			continue
+		}
+
+		hs.Lock()
+		hs.ejections++
+		dur := od.baseEjection * time.Duration(1<<uint(hs.ejections-1))
+		if dur > od.maxEjection || dur <= 0 {
+			dur = od.maxEjection
+		}
+		hs.ejectedUntil = time.Now().Add(dur)
+		// Start over with a fresh window once the host comes back
+		hs.samples = hs.samples[:0]
+		hs.next = 0
+		n := hs.ejections
+		hs.Unlock()
+
+		ejected++
+		host.setStateReason(fmt.Sprintf("outlier ejection: %v", reason))
+		host.updateState()
+		OutlierEjectionCount.WithLabelValues(host.Name(), reason).Inc()
+		log.Warningf("outlier: %v ejected for %v, reason: %v times: %v total: %v error: %.2f timeout: %.2f latency: %v",
+			host.Name(), dur, reason, n, sum.total, sum.errorRate, sum.timeoutRate, sum.latency)
+	}
+}
+
+// Return true if any other host of the same tag is neither down nor drained
+func (hc *HealthCheck) hasHealthyPeer(host *UpstreamHost) bool {
+	for _, peer := range hc.hosts {
+		if peer != host && peer.tag == host.tag && !peer.Drained() && !peer.Down() {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the ejection reason, empty string if host isn't an outlier
+func (hc *HealthCheck) outlierReason(host *UpstreamHost, sum windowSummary, summaries map[*UpstreamHost]windowSummary) string {
+	od := hc.outlier
+	if sum.total < od.minRequests {
+		return ""
+	}
+
+	var peers int
+	var errorRate, timeoutRate float64
+	var latencies []time.Duration
+	for peer, s := range summaries {
+		if peer == host || peer.tag != host.tag || s.total < od.minRequests || peer.Ejected() {
+			continue
+		}
+		peers++
+		errorRate += s.errorRate
+		timeoutRate += s.timeoutRate
+		if s.latency != 0 {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	if peers != 0 {
+		errorRate /= float64(peers)
+		timeoutRate /= float64(peers)
+	}
+
+	if od.errorRate > 0 && sum.errorRate-errorRate >= od.errorRate {
+		return "error_rate"
+	}
+	if od.timeoutRate > 0 && sum.timeoutRate-timeoutRate >= od.timeoutRate {
+		return "timeout_rate"
+	}
+	if od.latencyRatio > 0 && len(latencies) != 0 && sum.latency != 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		median := latencies[len(latencies)/2]
+		if float64(sum.latency) >= float64(median)*od.latencyRatio {
+			return "latency"
+		}
+	}
+	return ""
+}
+
+// Parses outlier_detection options:
+//	outlier_detection [interval] [window DUR] [min_hosts N] [min_requests N] [error_rate F] [timeout_rate F]
+//		[latency_percentile P] [latency_ratio F] [ejection DUR] [max_ejection DUR] [max_ejection_percent N]
+func parseOutlierDetection(c *caddy.Controller) (*outlierDetection, error) {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	od := newOutlierDetection()
+
+	i := 0
+	if len(args) != 0 {
+		if dur, err := time.ParseDuration(args[0]); err == nil {
+			od.interval = dur
+			i++
+		}
+	}
+	for ; i < len(args); i += 2 {
+		opt := args[i]
+		if i+1 >= len(args) {
+			return nil, c.Errf("%v: %v expects a value", dir, opt)
+		}
+		val := args[i+1]
+		var err error
+		switch opt {
+		case "window":
+			od.window, err = parseDuration0(dir, val)
+		case "ejection":
+			od.baseEjection, err = parseDuration0(dir, val)
+		case "max_ejection":
+			od.maxEjection, err = parseDuration0(dir, val)
+		case "min_hosts":
+			od.minHosts, err = strconv.Atoi(val)
+		case "min_requests":
+			od.minRequests, err = strconv.Atoi(val)
+		case "max_ejection_percent":
+			od.maxEjectionPercent, err = strconv.Atoi(val)
+		case "error_rate":
+			od.errorRate, err = strconv.ParseFloat(val, 64)
+		case "timeout_rate":
+			od.timeoutRate, err = strconv.ParseFloat(val, 64)
+		case "latency_percentile":
+			od.latencyPct, err = strconv.ParseFloat(val, 64)
+		case "latency_ratio":
+			od.latencyRatio, err = strconv.ParseFloat(val, 64)
+		default:
+			return nil, c.Errf("%v: unknown option: %v", dir, opt)
+		}
+		if err != nil {
+			return nil, c.Errf("%v: invalid %v %q: %v", dir, opt, val, err)
+		}
+	}
+
+	if od.interval < minOutlierInterval {
+		return nil, c.Errf("%v: minimal interval is %v", dir, minOutlierInterval)
+	}
+	if od.window < od.interval {
+		return nil, c.Errf("%v: window %v shorter than interval %v", dir, od.window, od.interval)
+	}
+	if od.baseEjection <= 0 || od.maxEjection < od.baseEjection {
+		return nil, c.Errf("%v: invalid ejection %v max_ejection %v", dir, od.baseEjection, od.maxEjection)
+	}
+	if od.minHosts < 2 {
+		return nil, c.Errf("%v: min_hosts %v must be at least 2", dir, od.minHosts)
+	}
+	if od.latencyPct <= 0 || od.latencyPct > 100 {
+		return nil, c.Errf("%v: latency_percentile %v out of range (0, 100]", dir, od.latencyPct)
+	}
+	if od.maxEjectionPercent < 0 || od.maxEjectionPercent > 100 {
+		return nil, c.Errf("%v: max_ejection_percent %v out of range [0, 100]", dir, od.maxEjectionPercent)
+	}
+	return od, nil
+}
+
+const (
+	maxOutlierSamples = 1024
+
+	defaultOutlierInterval     = 5 * time.Second
+	defaultOutlierWindow       = 30 * time.Second
+	defaultOutlierMinHosts     = 2
+	defaultOutlierMinRequests  = 10
+	defaultOutlierBaseEjection = 30 * time.Second
+	defaultOutlierMaxEjection  = 5 * time.Minute
+
+	minOutlierInterval = 1 * time.Second
+)
@@ -0,0 +1,89 @@
+package metadnsq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDetectOutliers(t *testing.T) {
+	hc := &HealthCheck{outlier: newOutlierDetection()}
+	for _, addr := range []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"} {
+		hc.hosts = append(hc.hosts, &UpstreamHost{tag: "t1", addr: addr, stats: newHostStats()})
+	}
+
+	timeout := &timeoutError{}
+	for i := 0; i < 20; i++ {
+		hc.hosts[0].recordOutcome(10*time.Millisecond, nil, nil)
+		hc.hosts[1].recordOutcome(10*time.Millisecond, nil, nil)
+		if i%2 == 0 {
+			hc.hosts[2].recordOutcome(2*time.Second, nil, timeout)
+		} else {
+			hc.hosts[2].recordOutcome(10*time.Millisecond, nil, nil)
+		}
+	}
+
+	hc.detectOutliers()
+	if hc.hosts[0].Ejected() || hc.hosts[1].Ejected() {
+		t.Errorf("Healthy hosts shouldn't be ejected")
+	}
+	if !hc.hosts[2].Ejected() {
+		t.Errorf("Expected %v to be ejected", hc.hosts[2].addr)
+	}
+
+	// Ejection period grows on repeated ejection
+	first := hc.hosts[2].stats.ejectedUntil
+	hc.hosts[2].stats.ejectedUntil = time.Time{}
+	for i := 0; i < 20; i++ {
+		hc.hosts[2].recordOutcome(0, nil, errors.New("connection refused"))
+	}
+	hc.detectOutliers()
+	if !hc.hosts[2].Ejected() {
+		t.Errorf("Expected %v to be ejected again", hc.hosts[2].addr)
+	}
+	if second := hc.hosts[2].stats.ejectedUntil; second.Sub(first) < hc.outlier.baseEjection/2 {
+		t.Errorf("Expected longer ejection, got %v then %v", first, second)
+	}
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func TestDetectOutliersLastHealthy(t *testing.T) {
+	hc := &HealthCheck{outlier: newOutlierDetection()}
+	for _, host := range []*UpstreamHost{
+		{tag: "t1", addr: "1.1.1.1:53"},
+		{tag: "t1", addr: "8.8.8.8:53"},
+		// Single-host tag, below min_hosts
+		{tag: "t2", addr: "9.9.9.9:53"},
+		// Two-host tag whose peer is down
+		{tag: "t3", addr: "114.114.114.114:53"},
+		{tag: "t3", addr: "223.5.5.5:53", fails: 1},
+	} {
+		host.stats = newHostStats()
+		hc.hosts = append(hc.hosts, host)
+	}
+	// Allow ejecting all of them so that only min_hosts and last healthy host guards apply
+	hc.outlier.maxEjectionPercent = 100
+
+	for i := 0; i < 20; i++ {
+		hc.hosts[0].recordOutcome(10*time.Millisecond, nil, nil)
+		hc.hosts[1].recordOutcome(0, nil, errors.New("connection refused"))
+		hc.hosts[2].recordOutcome(0, nil, errors.New("connection refused"))
+		hc.hosts[3].recordOutcome(0, nil, errors.New("connection refused"))
+	}
+
+	hc.detectOutliers()
+	if !hc.hosts[1].Ejected() {
+		t.Errorf("Expected %v to be ejected", hc.hosts[1].addr)
+	}
+	if hc.hosts[2].Ejected() {
+		t.Errorf("Single host of a tag shouldn't be ejected")
+	}
+	if hc.hosts[3].Ejected() {
+		t.Errorf("Last healthy host of a tag shouldn't be ejected")
+	}
+}
@@ -0,0 +1,151 @@
+package metadnsq
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Inline domain patterns of a matcher, compiled at setup time
+//	full:<domain>     exact match
+//	domain:<domain>   the domain and its subdomains
+//	*.<domain>        subdomains only
+//	keyword:<string>  name contains the keyword
+//	regexp:<regexp>   name matches the regular expression
+type namePatterns struct {
+	full      StringSet
+	domains   domainSet
+	wildcards domainSet
+	keywords  []string
+	regexps   []*regexp.Regexp
+}
+
+func newNamePatterns() *namePatterns {
+	return &namePatterns{
+		full:      make(StringSet),
+		domains:   make(domainSet),
+		wildcards: make(domainSet),
+	}
+}
+
+// Return true if s looks like an inline pattern rather than a datahub tag
+func isNamePattern(s string) bool {
+	if strings.HasPrefix(s, "*.") {
+		return true
+	}
+	for _, prefix := range namePatternPrefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *namePatterns) Add(s string) error {
+	switch {
+	case strings.HasPrefix(s, "*."):
+		if !p.wildcards.Add(s[2:]) {
+			return fmt.Errorf("invalid wildcard pattern %q", s)
+		}
+	case strings.HasPrefix(s, "full:"):
+		name, ok := stringToDomain(s[5:])
+		if !ok {
+			return fmt.Errorf("invalid full pattern %q", s)
+		}
+		p.full.Add(name)
+	case strings.HasPrefix(s, "domain:"):
+		if !p.domains.Add(s[7:]) {
+			return fmt.Errorf("invalid domain pattern %q", s)
+		}
+	case strings.HasPrefix(s, "keyword:"):
+		keyword := strings.ToLower(s[8:])
+		if keyword == "" {
+			return fmt.Errorf("empty keyword pattern %q", s)
+		}
+		p.keywords = append(p.keywords, keyword)
+	case strings.HasPrefix(s, "regexp:"):
+		re, err := regexp.Compile(s[7:])
+		if err != nil {
+			return fmt.Errorf("invalid regexp pattern %q: %v", s, err)
+		}
+		p.regexps = append(p.regexps, re)
+	default:
+		return fmt.Errorf("unknown pattern %q", s)
+	}
+	return nil
+}
+
+func (p *namePatterns) Len() int {
+	return len(p.full) + int(p.domains.Len()) + int(p.wildcards.Len()) + len(p.keywords) + len(p.regexps)
+}
+
+func (p *namePatterns) String() string {
+	var patterns []string
+	for name := range p.full {
+		patterns = append(patterns, "full:"+name)
+	}
+	_ = p.domains.ForEachDomain(func(name string) error {
+		patterns = append(patterns, "domain:"+name)
+		return nil
+	})
+	_ = p.wildcards.ForEachDomain(func(name string) error {
+		patterns = append(patterns, "*."+name)
+		return nil
+	})
+	for _, keyword := range p.keywords {
+		patterns = append(patterns, "keyword:"+keyword)
+	}
+	for _, re := range p.regexps {
+		patterns = append(patterns, "regexp:"+re.String())
+	}
+	sort.Strings(patterns)
+	return strings.Join(patterns, ",")
+}
+
+// Name is matched case-insensitively, trailing dot is ignored
+func (p *namePatterns) Match(name string) bool {
+	if p.Len() == 0 {
+		return false
+	}
+	name = removeTrailingDot(strings.ToLower(name))
+	if name == "" {
+		return false
+	}
+
+	if p.full.Contains(name) || p.domains.Match(name) {
+		return true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 && i < len(name)-1 && p.wildcards.Match(name[i+1:]) {
+		return true
+	}
+	for _, keyword := range p.keywords {
+		if strings.Contains(name, keyword) {
+			return true
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split matcher arguments into datahub tags and inline patterns
+func parseNamePatterns(args []string) ([]string, *namePatterns, error) {
+	var tags []string
+	patterns := newNamePatterns()
+	for _, arg := range args {
+		if !isNamePattern(arg) {
+			tags = append(tags, arg)
+			continue
+		}
+		if err := patterns.Add(arg); err != nil {
+			return nil, nil, err
+		}
+	}
+	return tags, patterns, nil
+}
+
+var namePatternPrefixes = []string{"full:", "domain:", "keyword:", "regexp:"}
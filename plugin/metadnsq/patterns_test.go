@@ -0,0 +1,54 @@
+package metadnsq
+
+import (
+	"testing"
+)
+
+func TestNamePatterns(t *testing.T) {
+	tags, p, err := parseNamePatterns([]string{
+		"ads",
+		"full:www.example.com",
+		"domain:example.org",
+		"*.example.net",
+		"keyword:tracker",
+		`regexp:^cdn[0-9]+\.example\.io$`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0] != "ads" {
+		t.Errorf("Expected tags [ads], got %v", tags)
+	}
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"www.example.com", true},
+		{"WWW.Example.COM.", true},
+		{"example.com", false},
+		{"a.www.example.com", false},
+		{"example.org", true},
+		{"a.b.example.org", true},
+		{"notexample.org", false},
+		{"example.net", false},
+		{"a.example.net", true},
+		{"a.b.example.net", true},
+		{"my-tracker.example.cn", true},
+		{"cdn12.example.io", true},
+		{"cdn.example.io", false},
+		{"example.io", false},
+		{".", false},
+	}
+	for _, test := range tests {
+		if matched := p.Match(test.name); matched != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.name, test.expected, matched)
+		}
+	}
+
+	for _, bad := range []string{"full:", "domain:", "*.", "keyword:", "regexp:(", "full:a..b"} {
+		if _, _, err := parseNamePatterns([]string{bad}); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
@@ -7,10 +7,11 @@ import (
 
 // SupportedPolicies is the collection of policies registered
 var SupportedPolicies = map[string]Policy{
-	"random":      &Random{},
-	"round_robin": &RoundRobin{},
-	"sequential":  &Sequential{},
-	"spray":       &Spray{},
+	"random":            &Random{},
+	"round_robin":       &RoundRobin{},
+	"sequential":        &Sequential{},
+	"spray":             &Spray{},
+	"least_outstanding": &LeastOutstanding{},
 }
 
 // Policy decides how a host will be selected from a pool.
@@ -19,7 +20,7 @@ var SupportedPolicies = map[string]Policy{
 //	to prevent no traffic to go through at all.
 type Policy interface {
 	// nil will be selected if all hosts are down
-	// NOTE: Spray policy will always return a nonnull host
+	// NOTE: Spray policy will always return a nonnull host unless all hosts are drained
 	Select(pool UpstreamHostPool) *UpstreamHost
 	SelectByTag(pool UpstreamHostPool, tags string) *UpstreamHost
 }
@@ -35,7 +36,7 @@ func (r *Random) SelectByTag(pool UpstreamHostPool, tag string) *UpstreamHost {
 	var randHost *UpstreamHost
 	count := 0
 	for _, host := range pool {
-		if host.Down() {
+		if unavailable(host) {
 			continue
 		}
 		if tag != "" && host.tag != tag {
@@ -74,20 +75,16 @@ func (r *RoundRobin) Select(pool UpstreamHostPool) *UpstreamHost {
 func (r *RoundRobin) SelectByTag(pool UpstreamHostPool, tag string) *UpstreamHost {
 	poolLen := uint32(len(pool))
 	selection := atomic.AddUint32(&r.robin, 1) % poolLen
-	host := pool[selection]
-	// Move forward to next one if the currently selected host is down
-	for i := uint32(1); host.Down() && i < poolLen; i++ {
-		_host := pool[(selection+i)%poolLen]
-		if tag != "" && _host.tag != tag {
+	// Move forward to next one if the currently selected host is down or of another tag
+	for i := uint32(0); i < poolLen; i++ {
+		host := pool[(selection+i)%poolLen]
+		if unavailable(host) || (tag != "" && host.tag != tag) {
 			continue
 		}
-		host = _host
-	}
-	if host.Down() {
-		// All hosts are down, we should return nil to honor Spray.Select()
-		return nil
+		return host
 	}
-	return host
+	// All hosts are down, we should return nil to honor Spray.Select()
+	return nil
 }
 
 // Sequential is a policy that selects always the first healthy host in the list order.
@@ -103,7 +100,7 @@ func (s *Sequential) Select(pool UpstreamHostPool) *UpstreamHost {
 func (s *Sequential) SelectByTag(pool UpstreamHostPool, tag string) *UpstreamHost {
 	for i := 0; i < len(pool); i++ {
 		host := pool[i]
-		if host.Down() {
+		if unavailable(host) {
 			continue
 		}
 		if tag != "" && host.tag != tag {
@@ -114,6 +111,45 @@ func (s *Sequential) SelectByTag(pool UpstreamHostPool, tag string) *UpstreamHos
 	return nil
 }
 
+// LeastOutstanding is a policy that selects the up host with the fewest in-flight requests.
+// Ties are broken at random, see: Random.SelectByTag()
+type LeastOutstanding struct{}
+
+func (l *LeastOutstanding) String() string { return "least_outstanding" }
+
+// Select selects an up host with the least outstanding requests from the specified pool.
+func (l *LeastOutstanding) Select(pool UpstreamHostPool) *UpstreamHost {
+	return l.SelectByTag(pool, "")
+}
+
+func (l *LeastOutstanding) SelectByTag(pool UpstreamHostPool, tag string) *UpstreamHost {
+	var bestHost *UpstreamHost
+	var least int32
+	count := 0
+	for _, host := range pool {
+		if unavailable(host) {
+			continue
+		}
+		if tag != "" && host.tag != tag {
+			continue
+		}
+		n := host.Inflight()
+		if bestHost == nil || n < least {
+			bestHost = host
+			least = n
+			count = 1
+			continue
+		}
+		if n == least {
+			count++
+			if rand.Int()%count == count-1 {
+				bestHost = host
+			}
+		}
+	}
+	return bestHost
+}
+
 // Spray is a policy that selects a host from a pool at random.
 // This should be used as a last ditch attempt to get
 //	a host when all hosts are reporting unhealthy.
@@ -125,10 +161,28 @@ func (s *Spray) SelectByTag(pool UpstreamHostPool, tag string) *UpstreamHost {
 	return s.Select(pool)
 }
 
-// Select selects an up host at random from the specified pool.
+// Select selects a host at random from the specified pool, drained hosts are never selected.
 func (s *Spray) Select(pool UpstreamHostPool) *UpstreamHost {
-	i := rand.Int() % len(pool)
-	randHost := pool[i]
+	var randHost *UpstreamHost
+	count := 0
+	for _, host := range pool {
+		if host.Drained() {
+			continue
+		}
+		count++
+		if rand.Int()%count == count-1 {
+			randHost = host
+		}
+	}
+	if randHost == nil {
+		log.Warningf("All hosts are drained, nothing to spray")
+		return nil
+	}
 	log.Warningf("All hosts reported as down, spraying to target: %s", randHost.Name())
 	return randHost
 }
+
+// Return true if the host shouldn't take any new traffic
+func unavailable(host *UpstreamHost) bool {
+	return host.Drained() || host.Down()
+}
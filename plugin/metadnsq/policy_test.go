@@ -0,0 +1,139 @@
+package metadnsq
+
+import (
+	"testing"
+)
+
+func TestLeastOutstanding(t *testing.T) {
+	pool := UpstreamHostPool{
+		{tag: "t1", addr: "1.1.1.1:53", inflight: 3},
+		{tag: "t1", addr: "8.8.8.8:53", inflight: 1},
+		{tag: "t2", addr: "9.9.9.9:53", inflight: 0},
+		{tag: "t2", addr: "114.114.114.114:53", inflight: 0, fails: 1},
+	}
+	policy := &LeastOutstanding{}
+
+	if h := policy.Select(pool); h != pool[2] {
+		t.Errorf("Select() expected %v, got %v", pool[2].addr, h)
+	}
+	if h := policy.SelectByTag(pool, "t1"); h != pool[1] {
+		t.Errorf("SelectByTag(t1) expected %v, got %v", pool[1].addr, h)
+	}
+
+	// Ties should be broken at random among the least loaded hosts
+	pool[0].inflight = 1
+	seen := make(map[*UpstreamHost]bool)
+	for i := 0; i < 100; i++ {
+		seen[policy.SelectByTag(pool, "t1")] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("SelectByTag(t1) expected both hosts to be selected, got %v", len(seen))
+	}
+
+	for _, host := range pool {
+		host.fails = 1
+	}
+	if h := policy.Select(pool); h != nil {
+		t.Errorf("Select() expected nil when all hosts are down, got %v", h.addr)
+	}
+}
+
+func TestDrainedHost(t *testing.T) {
+	pool := UpstreamHostPool{
+		{tag: "t1", addr: "1.1.1.1:53"},
+		{tag: "t1", addr: "8.8.8.8:53"},
+	}
+	pool[0].SetDrained(true)
+
+	for name, policy := range SupportedPolicies {
+		for i := 0; i < 10; i++ {
+			if h := policy.Select(pool); h != pool[1] {
+				t.Errorf("%v: expected %v, got %v", name, pool[1].addr, h)
+				break
+			}
+		}
+	}
+
+	pool[1].SetDrained(true)
+	if h := (&Spray{}).Select(pool); h != nil {
+		t.Errorf("Spray expected nil when all hosts are drained, got %v", h.addr)
+	}
+
+	pool[0].SetDrained(false)
+	hc := &HealthCheck{hosts: pool, spray: &Spray{}}
+	pool[0].fails = 1
+	if h := hc.Select(); h != pool[0] {
+		t.Errorf("Expected spraying to the only non-drained host, got %v", h)
+	}
+}
+
+// A drained host is skipped even if it would be preferred otherwise
+func TestDrainedHostPreferred(t *testing.T) {
+	pool := UpstreamHostPool{
+		{tag: "t1", addr: "1.1.1.1:53", inflight: 0},
+		{tag: "t1", addr: "8.8.8.8:53", inflight: 5},
+		{tag: "t1", addr: "9.9.9.9:53", inflight: 9},
+	}
+	pool[0].SetDrained(true)
+
+	lo := &LeastOutstanding{}
+	if h := lo.Select(pool); h != pool[1] {
+		t.Errorf("least_outstanding: expected %v, got %v", pool[1].addr, h)
+	}
+	if h := lo.SelectByTag(pool, "t1"); h != pool[1] {
+		t.Errorf("least_outstanding: SelectByTag(t1) expected %v, got %v", pool[1].addr, h)
+	}
+
+	// Spray ignores health state but never drain state
+	pool[1].fails = 1
+	pool[2].fails = 1
+	for i := 0; i < 50; i++ {
+		if h := (&Spray{}).Select(pool); h == pool[0] {
+			t.Fatalf("Spray selected drained host %v", h.addr)
+		}
+	}
+	hc := &HealthCheck{hosts: pool, policy: lo, spray: &Spray{}}
+	for i := 0; i < 50; i++ {
+		if h := hc.SelectByTag("t1"); h == nil || h == pool[0] {
+			t.Fatalf("Expected spraying to non-drained hosts, got %v", h)
+		}
+	}
+}
+
+func TestSelectByTag(t *testing.T) {
+	pool := UpstreamHostPool{
+		{tag: "domestic", addr: "114.114.114.114:53"},
+		{tag: "foreign", addr: "8.8.8.8:53"},
+		{tag: "foreign", addr: "1.1.1.1:53"},
+	}
+
+	// Hosts of other tags must never be picked, whichever the round robin starts from
+	policy := &RoundRobin{}
+	for i := 0; i < 10; i++ {
+		if h := policy.SelectByTag(pool, "domestic"); h != pool[0] {
+			t.Fatalf("RoundRobin expected %v, got %v", pool[0].addr, h)
+		}
+	}
+
+	hc := &HealthCheck{hosts: pool, policy: &RoundRobin{}, spray: &Spray{}}
+	seen := make(map[*UpstreamHost]bool)
+	for i := 0; i < 10; i++ {
+		h := hc.SelectByTag("foreign")
+		if h == nil || h.tag != "foreign" {
+			t.Fatalf("Expected a foreign host, got %v", h)
+		}
+		seen[h] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected both foreign hosts to be selected, got %v", len(seen))
+	}
+
+	// Spraying is limited to hosts of the tag too
+	pool[0].fails = 1
+	if h := hc.SelectByTag("domestic"); h != pool[0] {
+		t.Errorf("Expected spraying to %v, got %v", pool[0].addr, h)
+	}
+	if h := hc.SelectByTag("nonexistent"); h != nil {
+		t.Errorf("Expected nil for unknown tag, got %v", h.addr)
+	}
+}
@@ -7,6 +7,8 @@ import (
 type ResponseReverter struct {
 	dns.ResponseWriter
 	removeEcs bool
+	ttl       ttlRewrite
+	strip     recordStrip
 }
 
 func NewResponseReverter(w dns.ResponseWriter) *ResponseReverter {
@@ -27,5 +29,7 @@ func (r *ResponseReverter) WriteMsg(res1 *dns.Msg) error {
 	if r.removeEcs {
 		removeECS(res)
 	}
+	r.strip.apply(res)
+	r.ttl.apply(res)
 	return r.ResponseWriter.WriteMsg(res)
 }
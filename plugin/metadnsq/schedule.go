@@ -0,0 +1,131 @@
+package metadnsq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A weekly time window in which a matcher is active, i.e. mon-fri 09:00-18:00 Asia/Shanghai
+// Windows crossing midnight belong to the day they start, i.e. fri 22:00-06:00 ends at Saturday 06:00
+type schedule struct {
+	days  [7]bool // Indexed by time.Weekday
+	start int     // Minutes since midnight, inclusive
+	end   int     // Minutes since midnight, exclusive
+	loc   *time.Location
+	text  string
+}
+
+func (sc *schedule) String() string {
+	return sc.text
+}
+
+func (sc *schedule) active(now time.Time) bool {
+	t := now.In(sc.loc)
+	minute := t.Hour()*60 + t.Minute()
+	if sc.start < sc.end {
+		return sc.days[t.Weekday()] && minute >= sc.start && minute < sc.end
+	}
+	if minute >= sc.start {
+		return sc.days[t.Weekday()]
+	}
+	if minute < sc.end {
+		return sc.days[(t.Weekday()+6)%7]
+	}
+	return false
+}
+
+// schedule <days> <HH:MM-HH:MM> [timezone]
+//	days is a comma separated list of days or day ranges, i.e. mon-fri,sun, or * for every day
+//	timezone is an IANA time zone name, local time zone is used if omitted
+func parseSchedule(args []string) (*schedule, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("expected <days> <HH:MM-HH:MM> [timezone], got %q", args)
+	}
+	sc := &schedule{loc: time.Local, text: strings.Join(args, " ")}
+	if err := parseScheduleDays(args[0], &sc.days); err != nil {
+		return nil, err
+	}
+
+	window := strings.SplitN(args[1], "-", 2)
+	if len(window) != 2 {
+		return nil, fmt.Errorf("invalid time window %q", args[1])
+	}
+	var err error
+	if sc.start, err = parseClock(window[0]); err != nil {
+		return nil, err
+	}
+	if sc.end, err = parseClock(window[1]); err != nil {
+		return nil, err
+	}
+	if sc.start == sc.end {
+		return nil, fmt.Errorf("empty time window %q", args[1])
+	}
+	if sc.start == minutesPerDay {
+		return nil, fmt.Errorf("time window %q can't start at 24:00", args[1])
+	}
+
+	if len(args) == 3 {
+		if sc.loc, err = time.LoadLocation(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
+func parseScheduleDays(s string, days *[7]bool) error {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		r := strings.SplitN(item, "-", 2)
+		from, ok := weekdays[r[0]]
+		if !ok {
+			return fmt.Errorf("unknown day %q", r[0])
+		}
+		to := from
+		if len(r) == 2 {
+			if to, ok = weekdays[r[1]]; !ok {
+				return fmt.Errorf("unknown day %q", r[1])
+			}
+		}
+		// Ranges may wrap around the week, i.e. fri-mon
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Return minutes since midnight of HH:MM, 24:00 is allowed as the end of a day
+func parseClock(s string) (int, error) {
+	hm := strings.SplitN(s, ":", 2)
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	h, err1 := strconv.Atoi(hm[0])
+	m, err2 := strconv.Atoi(hm[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+const minutesPerDay = 24 * 60
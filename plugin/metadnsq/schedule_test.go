@@ -0,0 +1,88 @@
+package metadnsq
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"mon-fri 09:00-18:00", false},
+		{"mon-fri 09:00-18:00 Asia/Shanghai", false},
+		{"sat,sun 22:00-06:00 UTC", false},
+		{"fri-mon 00:00-24:00", false},
+		{"* 21:00-07:30", false},
+		{"mon-fri", true},
+		{"mon-fri 09:00-18:00 UTC extra", true},
+		{"someday 09:00-18:00", true},
+		{"mon-fri 09:00", true},
+		{"mon-fri 9-18", true},
+		{"mon-fri 09:60-18:00", true},
+		{"mon-fri 24:00-06:00", true},
+		{"mon-fri 09:00-09:00", true},
+		{"mon-fri 09:00-18:00 Mars/Olympus", true},
+	}
+	for i, test := range tests {
+		_, err := parseSchedule(strings.Fields(test.input))
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test#%v %q: shouldErr %v, got %v", i, test.input, test.shouldErr, err)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	work, _ := parseSchedule([]string{"mon-fri", "09:00-18:00", "Asia/Shanghai"})
+	night, _ := parseSchedule([]string{"fri", "22:00-06:00", "Asia/Shanghai"})
+
+	tests := []struct {
+		sc       *schedule
+		now      time.Time
+		expected bool
+	}{
+		// 2026-10-19 is a Monday
+		{work, time.Date(2026, 10, 19, 9, 0, 0, 0, shanghai), true},
+		{work, time.Date(2026, 10, 19, 17, 59, 0, 0, shanghai), true},
+		{work, time.Date(2026, 10, 19, 18, 0, 0, 0, shanghai), false},
+		{work, time.Date(2026, 10, 18, 12, 0, 0, 0, shanghai), false},
+		// 01:00 UTC is 09:00 in Shanghai
+		{work, time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC), true},
+		{night, time.Date(2026, 10, 23, 23, 0, 0, 0, shanghai), true},
+		{night, time.Date(2026, 10, 24, 5, 59, 0, 0, shanghai), true},
+		{night, time.Date(2026, 10, 24, 6, 0, 0, 0, shanghai), false},
+		{night, time.Date(2026, 10, 23, 5, 0, 0, 0, shanghai), false},
+	}
+	for i, test := range tests {
+		if active := test.sc.active(test.now); active != test.expected {
+			t.Errorf("Test#%v %v at %v: expected %v, got %v", i, test.sc, test.now, test.expected, active)
+		}
+	}
+}
+
+// Schedule gauge is set per server, and only when the active state flips
+func TestObserveSchedule(t *testing.T) {
+	m := newSubMatcher()
+	for i, test := range []struct {
+		server   string
+		active   bool
+		expected bool
+	}{
+		{"dns://:53", true, true},
+		{"dns://:53", true, false},
+		{"tls://:853", true, true},
+		{"dns://:53", false, true},
+		{"dns://:53", false, false},
+		{"tls://:853", true, false},
+	} {
+		if set := m.observeSchedule(test.server, test.active); set != test.expected {
+			t.Errorf("Test#%v expected gauge set %v, got %v", i, test.expected, set)
+		}
+	}
+}
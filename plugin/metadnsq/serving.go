@@ -0,0 +1,158 @@
+package metadnsq
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// A local listen address condition, either part may be omitted
+//	<ip|cidr>, :<port>, <ip>:<port>, [<ipv6>]:<port>
+type listenAddr struct {
+	net  *net.IPNet // nil for any address
+	port string     // Empty for any port
+	text string
+}
+
+func (l *listenAddr) String() string {
+	return l.text
+}
+
+func (l *listenAddr) match(ip net.IP, port string) bool {
+	if l.port != "" && l.port != port {
+		return false
+	}
+	return l.net == nil || (ip != nil && l.net.Contains(ip))
+}
+
+func parseListenAddr(s string) (*listenAddr, error) {
+	l := &listenAddr{text: s}
+	host := s
+	if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		var err error
+		if host, l.port, err = net.SplitHostPort(s); err != nil {
+			return nil, err
+		}
+		port, err := net.LookupPort("udp", l.port)
+		if err != nil || l.port == "" {
+			return nil, fmt.Errorf("invalid port in %q", s)
+		}
+		l.port = strconv.Itoa(port)
+	}
+	if host == "" {
+		return l, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		l.net = hostIPNet(ip)
+		return l, nil
+	}
+	_, n, err := net.ParseCIDR(host)
+	if err != nil || l.port != "" {
+		return nil, fmt.Errorf("%q isn't an IP address, CIDR or address with port", s)
+	}
+	l.net = n
+	return l, nil
+}
+
+// Return client transport of the request: udp, tcp, tls, https or grpc
+// Server scheme is checked first since the writer may be wrapped by other plugins
+func requestTransport(server string, state *request.Request) string {
+	if i := strings.Index(server, "://"); i > 0 {
+		switch scheme := server[:i]; scheme {
+		case transportTls, transportHttps, transportGrpc:
+			return scheme
+		}
+	}
+	if _, ok := state.W.(*dnsserver.DoHWriter); ok {
+		return transportHttps
+	}
+	if cs, ok := state.W.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return transportTls
+	}
+	return state.Proto()
+}
+
+func (m *subMatcher) matchServer(server string) bool {
+	if _, ok := m.nonServers[server]; ok {
+		return false
+	}
+	if len(m.servers) == 0 {
+		return true
+	}
+	_, ok := m.servers[server]
+	return ok
+}
+
+func (m *subMatcher) matchTransport(transport string) bool {
+	if _, ok := m.nonTransports[transport]; ok {
+		return false
+	}
+	if len(m.transports) == 0 {
+		return true
+	}
+	_, ok := m.transports[transport]
+	return ok
+}
+
+func (m *subMatcher) matchListen(ip net.IP, port string) bool {
+	for _, l := range m.nonListens {
+		if l.match(ip, port) {
+			return false
+		}
+	}
+	if len(m.listens) == 0 {
+		return true
+	}
+	for _, l := range m.listens {
+		if l.match(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *subMatcher) servingString() string {
+	var conds []string
+	for s := range m.servers {
+		conds = append(conds, "server:"+s)
+	}
+	for s := range m.nonServers {
+		conds = append(conds, "!server:"+s)
+	}
+	for t := range m.transports {
+		conds = append(conds, "transport:"+t)
+	}
+	for t := range m.nonTransports {
+		conds = append(conds, "!transport:"+t)
+	}
+	for _, l := range m.listens {
+		conds = append(conds, "listen:"+l.String())
+	}
+	for _, l := range m.nonListens {
+		conds = append(conds, "!listen:"+l.String())
+	}
+	sort.Strings(conds)
+	return strings.Join(conds, ",")
+}
+
+func isTransport(s string) bool {
+	switch s {
+	case transportUdp, transportTcp, transportTls, transportHttps, transportGrpc:
+		return true
+	}
+	return false
+}
+
+const (
+	transportUdp   = "udp"
+	transportTcp   = "tcp"
+	transportTls   = "tls"
+	transportHttps = "https"
+	transportGrpc  = "grpc"
+)
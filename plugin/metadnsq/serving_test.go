@@ -0,0 +1,85 @@
+package metadnsq
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		ip        string
+		port      string
+		expected  bool
+	}{
+		{":53", false, "10.0.0.1", "53", true},
+		{":53", false, "10.0.0.1", "5353", false},
+		{"10.0.0.1", false, "10.0.0.1", "53", true},
+		{"10.0.0.1:53", false, "10.0.0.1", "53", true},
+		{"10.0.0.1:53", false, "10.0.0.2", "53", false},
+		{"192.168.10.0/24", false, "192.168.10.1", "853", true},
+		{"192.168.10.0/24", false, "192.168.11.1", "853", false},
+		{"[fd00::1]:53", false, "fd00::1", "53", true},
+		{"fd00::/8", false, "fd00::1", "53", true},
+		{":foo", true, "", "", false},
+		{"foo", true, "", "", false},
+		{"10.0.0.0/8:53", true, "", "", false},
+	}
+	for i, test := range tests {
+		l, err := parseListenAddr(test.input)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test#%v %q: shouldErr %v, got %v", i, test.input, test.shouldErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if matched := l.match(net.ParseIP(test.ip), test.port); matched != test.expected {
+			t.Errorf("Test#%v %q: %v:%v expected %v, got %v", i, test.input, test.ip, test.port, test.expected, matched)
+		}
+	}
+}
+
+func TestRequestTransport(t *testing.T) {
+	state := &request.Request{W: &dnsserver.DoHWriter{}, Req: new(dns.Msg)}
+	if tr := requestTransport("dns://:53", state); tr != transportHttps {
+		t.Errorf("Expected %v for DoH writer, got %v", transportHttps, tr)
+	}
+	state = &request.Request{W: &remoteWriter{remote: net.ParseIP("10.0.0.1")}, Req: new(dns.Msg)}
+	if tr := requestTransport("tls://:853", state); tr != transportTls {
+		t.Errorf("Expected %v for tls server, got %v", transportTls, tr)
+	}
+}
+
+func TestMatchServing(t *testing.T) {
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n"+
+		"matcher { \n name guest \n listen 192.168.100.0/24 \n transports !tls !https \n nxdomain \n } \n"+
+		"matcher { \n name public \n servers dns://:53 \n to t2 \n } \n }")
+	ms := u.subMatchers
+
+	tests := []struct {
+		s        *matchState
+		expected string
+	}{
+		{&matchState{server: "dns://:53", transport: "udp", localIP: net.ParseIP("192.168.100.1"), localPort: "53"}, "guest"},
+		{&matchState{server: "tls://:853", transport: "tls", localIP: net.ParseIP("192.168.100.1"), localPort: "853"}, ""},
+		{&matchState{server: "dns://:53", transport: "tcp", localIP: net.ParseIP("10.0.0.1"), localPort: "53"}, "public"},
+		{&matchState{server: "dns://:5353", transport: "udp", localIP: net.ParseIP("10.0.0.1"), localPort: "5353"}, ""},
+	}
+	for i, test := range tests {
+		test.s.name, test.s.qtype = "www.example.com", dns.TypeA
+		m := ms.matchQuery(test.s)
+		name := ""
+		if m != nil {
+			name = m.name
+		}
+		if name != test.expected {
+			t.Errorf("Test#%v: expected matcher %q, got %q", i, test.expected, name)
+		}
+	}
+}
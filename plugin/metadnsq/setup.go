@@ -19,6 +19,11 @@ func setup(c *caddy.Controller) error {
 		return PluginError(err)
 	}
 
+	admin, err := newAdminServer(ups)
+	if err != nil {
+		return PluginError(err)
+	}
+
 	r := &MetaForward{Upstreams: &ups}
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		r.Next = next
@@ -38,5 +43,13 @@ func setup(c *caddy.Controller) error {
 		return r.OnShutdown()
 	})
 
+	if admin != nil {
+		// Release the listen address before reload, so the new instance can take it over
+		c.OnStartup(admin.Start)
+		c.OnRestart(admin.Stop)
+		c.OnRestartFailed(admin.Start)
+		c.OnFinalShutdown(admin.Stop)
+	}
+
 	return nil
 }
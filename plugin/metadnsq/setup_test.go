@@ -2,10 +2,12 @@ package metadnsq
 
 import (
 	"fmt"
+	"net"
 	"strings"
 	"testing"
 
 	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 )
 
 type testCase struct {
@@ -41,6 +43,38 @@ func (t *testCase) Pass(err error) bool {
 	return pass
 }
 
+// Return the upstream parsed from a single server block
+func newTestUpstream(input string) (*reloadableUpstream, error) {
+	c := caddy.NewTestController("dns", input)
+	c.Next()
+	u, err := newReloadableUpstream(c)
+	if err != nil {
+		return nil, err
+	}
+	return u.(*reloadableUpstream), nil
+}
+
+// Ditto. fail the test immediately on error
+func mustTestUpstream(t *testing.T, input string) *reloadableUpstream {
+	t.Helper()
+	u, err := newTestUpstream(input)
+	if err != nil {
+		t.Fatalf("%q: %v", input, err)
+	}
+	return u
+}
+
+// Parse input of each test case and check the error against the expectation
+func runSetupTests(t *testing.T, tests []testCase) {
+	t.Helper()
+	for i, test := range tests {
+		_, err := newTestUpstream(test.input)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+}
+
 func TestSetupTo(t *testing.T) {
 	tests := []testCase{
 		// Negative
@@ -91,3 +125,42 @@ func TestParse(t *testing.T) {
 	}
 	t.Log(item)
 }
+
+func TestSetupHealthCheck(t *testing.T) {
+	tests := []testCase{
+		// Negative
+		{"metadnsq . { to t1 1.2.3.4 \n health_check \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s foo \n }", true, "unknown option"},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s probe example.com \n }", true, "expects a name and a type"},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s probe example.com FOO \n }", true, "unknown query type"},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s rcode FOO \n }", true, "unknown rcode"},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s answer_net \n }", true, "expects a netlist tag"},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s timeout \n }", true, "expects a duration"},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s timeout 0 \n }", true, "must be positive"},
+		{"metadnsq . { to t1 1.2.3.4 \n outlier_detection min_hosts 1 \n }", true, "must be at least 2"},
+		{"metadnsq . { to t1 1.2.3.4 \n canary www.google.com \n }", true, "Wrong argument count"},
+		{"metadnsq . { to t1 1.2.3.4 \n canary foo..com 8.8.8.8 \n }", true, "isn't a valid domain name"},
+		// Positive
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s no_rec \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s probe www.baidu.com A rcode NOERROR answer \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s no_rec probe www.qq.com aaaa answer_net cn \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s timeout 500ms tcp \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n outlier_detection 5s min_hosts 3 \n }", false, ""},
+		{"metadnsq . { to t1 1.2.3.4 \n health_check 5s \n canary www.google.com not_cn 142.250.0.0/15 \n }", false, ""},
+	}
+
+	runSetupTests(t, tests)
+}
+
+// Start a local UDP DNS server with handler, return its address
+func startTestServer(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
@@ -0,0 +1,176 @@
+package metadnsq
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ca17/datahub/plugin/pkg/netutils"
+	"github.com/miekg/dns"
+)
+
+// Record stripping of a matcher, applied to responses right before they're written
+//	strip aaaa|ipv6hint|ech...
+//	aaaa_nodata
+type recordStrip struct {
+	aaaa     bool // AAAA records in answer and additional sections
+	ipv6hint bool // ipv6hint param of HTTPS/SVCB records
+	ech      bool // ech param of HTTPS/SVCB records
+}
+
+func (s recordStrip) isEmpty() bool {
+	return !s.aaaa && !s.ipv6hint && !s.ech
+}
+
+func (s recordStrip) String() string {
+	var strs []string
+	if s.aaaa {
+		strs = append(strs, stripAaaa)
+	}
+	if s.ipv6hint {
+		strs = append(strs, stripIpv6hint)
+	}
+	if s.ech {
+		strs = append(strs, stripEch)
+	}
+	return strings.Join(strs, ",")
+}
+
+// Return union of s and o
+func (s recordStrip) merge(o recordStrip) recordStrip {
+	return recordStrip{
+		aaaa:     s.aaaa || o.aaaa,
+		ipv6hint: s.ipv6hint || o.ipv6hint,
+		ech:      s.ech || o.ech,
+	}
+}
+
+func (s recordStrip) apply(msg *dns.Msg) {
+	if s.isEmpty() {
+		return
+	}
+	msg.Answer = s.filter(msg.Answer)
+	msg.Extra = s.filter(msg.Extra)
+}
+
+func (s recordStrip) filter(rrs []dns.RR) []dns.RR {
+	filtered := rrs[:0]
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.AAAA:
+			if s.aaaa {
+				continue
+			}
+		case *dns.SVCB:
+			rr.Value = s.stripParams(rr.Value)
+		case *dns.HTTPS:
+			rr.Value = s.stripParams(rr.Value)
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered
+}
+
+func (s recordStrip) stripParams(params []dns.SVCBKeyValue) []dns.SVCBKeyValue {
+	stripped := func(key dns.SVCBKey) bool {
+		return (s.ipv6hint && key == dns.SVCB_IPV6HINT) || (s.ech && key == dns.SVCB_ECHCONFIG)
+	}
+	var kept []dns.SVCBKeyValue
+	for _, kv := range params {
+		if stripped(kv.Key()) {
+			continue
+		}
+		// Stripped keys must not be left in mandatory list, otherwise the record is malformed
+		if m, ok := kv.(*dns.SVCBMandatory); ok {
+			var codes []dns.SVCBKey
+			for _, code := range m.Code {
+				if !stripped(code) {
+					codes = append(codes, code)
+				}
+			}
+			if len(codes) == 0 {
+				continue
+			}
+			kv = &dns.SVCBMandatory{Code: codes}
+		}
+		kept = append(kept, kv)
+	}
+	return kept
+}
+
+func (s *recordStrip) parse(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected %v|%v|%v...", stripAaaa, stripIpv6hint, stripEch)
+	}
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case stripAaaa:
+			s.aaaa = true
+		case stripIpv6hint:
+			s.ipv6hint = true
+		case stripEch:
+			s.ech = true
+		default:
+			return fmt.Errorf("unknown strip target %q", arg)
+		}
+	}
+	return nil
+}
+
+// Remove A/AAAA records matching anwser_ips from reply, return number of removed records
+// Reply becomes NODATA if no record of the query type remains, so that no dangling CNAME chain is left
+func (m *subMatcher) dropAnwserRecords(reply *dns.Msg) int {
+	var kept []dns.RR
+	var dropped int
+	for _, rr := range reply.Answer {
+		var ip string
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		}
+		if ip != "" {
+			if ns, err := netutils.ParseIpNet(ip); err == nil && m.matchAnwserIp(ns) {
+				dropped++
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	if dropped == 0 {
+		return 0
+	}
+
+	reply.Answer = kept
+	if len(reply.Question) == 0 {
+		return dropped
+	}
+	qtype := reply.Question[0].Qtype
+	for _, rr := range kept {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			return dropped
+		}
+	}
+	reply.Rcode = dns.RcodeSuccess
+	reply.Answer = nil
+	reply.Ns = m.negativeSoa(reply)
+	return dropped
+}
+
+// Synthesize a NODATA response to req
+func (m *subMatcher) nodataReply(req *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.RecursionAvailable = true
+	msg.Ns = m.negativeSoa(req)
+	if o := req.IsEdns0(); o != nil {
+		msg.SetEdns0(o.UDPSize(), o.Do())
+	}
+	return msg
+}
+
+const (
+	stripAaaa     = "aaaa"
+	stripIpv6hint = "ipv6hint"
+	stripEch      = "ech"
+)
@@ -0,0 +1,127 @@
+package metadnsq
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ca17/datahub/plugin/pkg/stringset"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestRecordStrip(t *testing.T) {
+	var s recordStrip
+	if err := s.parse([]string{"AAAA", "ipv6hint", "ech"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := new(dns.Msg)
+	reply.SetQuestion("www.example.com.", dns.TypeHTTPS)
+	for _, str := range []string{
+		`www.example.com. 60 IN HTTPS 1 . alpn="h2" mandatory=ipv6hint ipv4hint="10.0.0.1" ipv6hint="fd00::1" echconfig="AAAA"`,
+		"www.example.com. 60 IN AAAA fd00::1",
+		"www.example.com. 60 IN A 10.0.0.1",
+	} {
+		rr, err := dns.NewRR(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply.Answer = append(reply.Answer, rr)
+	}
+	s.apply(reply)
+	if len(reply.Answer) != 2 {
+		t.Fatalf("Expected AAAA stripped, got %v", reply.Answer)
+	}
+	https := reply.Answer[0].(*dns.HTTPS)
+	for _, kv := range https.Value {
+		switch kv.Key() {
+		case dns.SVCB_IPV6HINT, dns.SVCB_ECHCONFIG, dns.SVCB_MANDATORY:
+			t.Errorf("Unexpected param %v", kv)
+		}
+	}
+	if len(https.Value) != 2 {
+		t.Errorf("Expected alpn and ipv4hint kept, got %v", https.Value)
+	}
+
+	nodata := newSubMatcher()
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeAAAA)
+	if msg := nodata.nodataReply(req); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 || len(msg.Ns) != 1 {
+		t.Errorf("Unexpected NODATA %v", msg)
+	}
+
+	if err := new(recordStrip).parse([]string{"ipv4hint"}); err == nil {
+		t.Errorf("Expected unknown strip target error")
+	}
+	if err := new(recordStrip).parse(nil); err == nil {
+		t.Errorf("Expected argument error")
+	}
+}
+
+func TestDropAnwserRecords(t *testing.T) {
+	newReply := func() *dns.Msg {
+		reply := new(dns.Msg)
+		reply.SetQuestion("www.example.com.", dns.TypeA)
+		for _, str := range []string{"www.example.com. 60 IN CNAME cdn.example.net.", "cdn.example.net. 60 IN A 10.0.0.1", "cdn.example.net. 60 IN A 10.0.0.2"} {
+			rr, _ := dns.NewRR(str)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		return reply
+	}
+
+	// Positive tags never match without datahub
+	m := newSubMatcher()
+	m.anwserIps = stringset.NewFromSlice([]string{"bogus"})
+	reply := newReply()
+	if n := m.dropAnwserRecords(reply); n != 0 || len(reply.Answer) != 3 {
+		t.Errorf("Expected nothing dropped, got %v %v", n, reply.Answer)
+	}
+
+	// Dangling CNAME is removed along with the dropped records
+	m = newSubMatcher()
+	m.nonAnwserIps = stringset.NewFromSlice([]string{"cn"})
+	reply = newReply()
+	if n := m.dropAnwserRecords(reply); n != 2 || len(reply.Answer) != 0 || len(reply.Ns) != 1 || reply.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NODATA, got %v %v", n, reply)
+	}
+
+	// Records of other types are kept
+	reply = newReply()
+	reply.Question[0].Qtype = dns.TypeCNAME
+	if n := m.dropAnwserRecords(reply); n != 2 || len(reply.Answer) != 1 || len(reply.Ns) != 0 {
+		t.Errorf("Expected CNAME kept, got %v %v", n, reply)
+	}
+}
+
+// Records removed by drop_records are never evaluated against later matchers
+func TestMatchAnwserAfterDrop(t *testing.T) {
+	// Negated tags match any address without datahub, so dropped addresses match the block matcher as well
+	u := mustTestUpstream(t, "metadnsq . { to t1 1.2.3.4 \n"+
+		"matcher { \n name drop \n anwser_ips !bogus \n drop_records \n } \n"+
+		"matcher { \n name block_ip \n anwser_ips !bogus \n block refused \n } \n"+
+		"matcher { \n name block_cname \n anwser_cnames !bogus \n block refused \n } \n }")
+
+	tests := []struct {
+		answers []string
+	}{
+		{[]string{"www.example.com. 60 IN A 10.0.0.1", "www.example.com. 60 IN A 10.0.0.2"}},
+		// CNAME is removed along with the dropped records, so it mustn't be matched either
+		{[]string{"cdn.example.net. 60 IN A 10.0.0.1", "www.example.com. 60 IN CNAME cdn.example.net."}},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		for _, str := range test.answers {
+			rr, _ := dns.NewRR(str)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		state := &request.Request{W: &remoteWriter{remote: net.ParseIP("127.0.0.1")}, Req: req}
+		rwrite := NewResponseReverter(state.W)
+		msg, _ := (&MetaForward{}).matchAnwser(u, state, &matchState{qtype: dns.TypeA}, rwrite, reply)
+		if msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 || len(msg.Ns) != 1 {
+			t.Errorf("Test#%v: expected NODATA, got %v", i, msg)
+		}
+	}
+}
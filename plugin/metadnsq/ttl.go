@@ -0,0 +1,108 @@
+package metadnsq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TTL rewriting of responses, configured at block level and overridden per matcher
+//	min_ttl <seconds>       floor of answer and authority TTLs
+//	max_ttl <seconds>       ceiling of answer and authority TTLs, takes precedence over min_ttl
+//	negative_ttl <seconds>  SOA TTL and minimum of NXDOMAIN and NODATA responses
+type ttlRewrite struct {
+	min      *uint32 // nil if not configured
+	max      *uint32
+	negative *uint32
+}
+
+func (t ttlRewrite) isEmpty() bool {
+	return t.min == nil && t.max == nil && t.negative == nil
+}
+
+func (t ttlRewrite) String() string {
+	var strs []string
+	for _, opt := range []struct {
+		name string
+		ttl  *uint32
+	}{{"min", t.min}, {"max", t.max}, {"negative", t.negative}} {
+		if opt.ttl != nil {
+			strs = append(strs, fmt.Sprintf("%v:%v", opt.name, *opt.ttl))
+		}
+	}
+	return strings.Join(strs, ",")
+}
+
+// Return t with options configured in o replaced
+func (t ttlRewrite) merge(o ttlRewrite) ttlRewrite {
+	if o.min != nil {
+		t.min = o.min
+	}
+	if o.max != nil {
+		t.max = o.max
+	}
+	if o.negative != nil {
+		t.negative = o.negative
+	}
+	return t
+}
+
+func (t ttlRewrite) clamp(ttl uint32) uint32 {
+	if t.min != nil && ttl < *t.min {
+		ttl = *t.min
+	}
+	if t.max != nil && ttl > *t.max {
+		ttl = *t.max
+	}
+	return ttl
+}
+
+// Rewrite TTLs of answer and authority sections, OPT and additional records are left untouched
+func (t ttlRewrite) apply(msg *dns.Msg) {
+	if t.isEmpty() {
+		return
+	}
+	negative := msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+	for _, rr := range msg.Answer {
+		rr.Header().Ttl = t.clamp(rr.Header().Ttl)
+	}
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			rr.Header().Ttl = t.clamp(rr.Header().Ttl)
+			continue
+		}
+		if negative && t.negative != nil {
+			soa.Hdr.Ttl, soa.Minttl = *t.negative, *t.negative
+			continue
+		}
+		soa.Hdr.Ttl, soa.Minttl = t.clamp(soa.Hdr.Ttl), t.clamp(soa.Minttl)
+	}
+}
+
+func (t *ttlRewrite) parse(dir string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected <seconds>, got %q", args)
+	}
+	n, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid ttl %q", args[0])
+	}
+	ttl := uint32(n)
+	switch dir {
+	case "min_ttl":
+		t.min = &ttl
+	case "max_ttl":
+		t.max = &ttl
+	case "negative_ttl":
+		t.negative = &ttl
+	default:
+		panic(fmt.Sprintf("Unexpected ttl directive %q", dir))
+	}
+	if t.min != nil && t.max != nil && *t.min > *t.max {
+		return fmt.Errorf("min_ttl %v is greater than max_ttl %v", *t.min, *t.max)
+	}
+	return nil
+}
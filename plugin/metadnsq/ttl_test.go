@@ -0,0 +1,64 @@
+package metadnsq
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTtlRewrite(t *testing.T) {
+	var block ttlRewrite
+	for _, args := range [][]string{{"min_ttl", "300"}, {"max_ttl", "3600"}, {"negative_ttl", "30"}} {
+		if err := block.parse(args[0], args[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply := new(dns.Msg)
+	reply.SetQuestion("www.example.com.", dns.TypeA)
+	for _, s := range []string{"www.example.com. 10 IN CNAME cdn.example.net.", "cdn.example.net. 86400 IN A 10.0.0.1"} {
+		rr, _ := dns.NewRR(s)
+		reply.Answer = append(reply.Answer, rr)
+	}
+	reply.SetEdns0(1232, false)
+	block.apply(reply)
+	if ttl := reply.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("Expected ttl raised to 300, got %v", ttl)
+	}
+	if ttl := reply.Answer[1].Header().Ttl; ttl != 3600 {
+		t.Errorf("Expected ttl lowered to 3600, got %v", ttl)
+	}
+	if ttl := reply.IsEdns0().Hdr.Ttl; ttl != 0 {
+		t.Errorf("Expected OPT untouched, got %v", ttl)
+	}
+
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion("nx.example.com.", dns.TypeA)
+	nxdomain.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("example.com. 900 IN SOA ns.example.com. root.example.com. 1 2 3 4 600")
+	nxdomain.Ns = append(nxdomain.Ns, soa)
+	block.apply(nxdomain)
+	if soa := nxdomain.Ns[0].(*dns.SOA); soa.Hdr.Ttl != 30 || soa.Minttl != 30 {
+		t.Errorf("Expected negative ttl 30, got %v", soa)
+	}
+
+	// Matcher options override block level ones
+	var matcher ttlRewrite
+	if err := matcher.parse("max_ttl", []string{"60"}); err != nil {
+		t.Fatal(err)
+	}
+	merged := block.merge(matcher)
+	if merged.clamp(10) != 60 || merged.clamp(7200) != 60 || *merged.negative != 30 {
+		t.Errorf("Unexpected merged %v", merged)
+	}
+	if *block.max != 3600 {
+		t.Errorf("Expected block level options unchanged, got %v", block)
+	}
+
+	if err := new(ttlRewrite).parse("min_ttl", []string{"-1"}); err == nil {
+		t.Errorf("Expected invalid ttl error")
+	}
+	if err := matcher.parse("min_ttl", []string{"120"}); err == nil {
+		t.Errorf("Expected min_ttl > max_ttl error")
+	}
+}
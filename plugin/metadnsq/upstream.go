@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -34,6 +35,17 @@ type reloadableUpstream struct {
 	matchAny  bool
 	noIPv6    bool
 	debug     bool
+
+	adminListen string // Admin HTTP API listen address, see: admin.go
+	adminToken  string // Bearer token of admin HTTP API, required if adminListen isn't loopback
+
+	clientSource      string       // Where client address comes from, see: client.go
+	trustedForwarders []*net.IPNet // Forwarders whose ECS is trusted as client address
+
+	ttl ttlRewrite // TTL rewriting of responses, see: ttl.go
+
+	bogusNxdomain *bogusNxdomain // nil if not configured, see: bogus.go
+	dual          *dualResolve   // nil if not configured, see: dual.go
 }
 
 // reloadableUpstream implements Upstream interface
@@ -140,6 +152,10 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 			stop:          make(chan struct{}),
 			maxFails:      defaultMaxFails,
 			checkInterval: defaultHcInterval,
+			timeout:       defaultHcTimeout,
+			probe:         newHcProbe(),
+			checkJitter:   defaultHcJitter,
+			maxBackoff:    defaultHcMaxBackoff,
 			transport: &Transport{
 				expire:           defaultConnExpire,
 				tlsConfig:        new(tls.Config),
@@ -161,6 +177,18 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 	if u.hosts == nil {
 		return nil, c.Errf("missing mandatory property: %q", "to")
 	}
+	for _, m := range u.subMatchers.matchers {
+		if m.reroute != "" && len(u.hosts.withTag(m.reroute)) == 0 {
+			return nil, c.Errf("reroute: no host of tag %q in matcher %v", m.reroute, m.label())
+		}
+	}
+	if d := u.dual; d != nil {
+		for _, tag := range []string{d.domestic, d.foreign} {
+			if len(u.hosts.withTag(tag)) == 0 {
+				return nil, c.Errf("dual: no host of tag %q", tag)
+			}
+		}
+	}
 	for _, host := range u.hosts {
 		addr, tlsServerName := SplitByByte(host.addr, '@')
 		host.addr = addr
@@ -190,16 +218,17 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 			}
 		}
 
-		network := protoToNetwork(host.proto)
-		if network == "dns" {
-			// Use classic DNS protocol for health checking
-			network = "udp"
-		}
-		host.c = &dns.Client{
-			Net:       network,
-			TLSConfig: host.transport.tlsConfig,
-			Timeout:   defaultHcTimeout,
+		// Health check goes through the same dialer as real queries
+		host.bootstrap = u.bootstrap
+		host.noIPv6 = u.noIPv6
+		host.probe = u.probe
+		host.hcTimeout = u.timeout
+		host.hcTcp = u.probeTcp
+		host.canaries = u.canaries
+		if u.outlier != nil {
+			host.stats = newHostStats()
 		}
+		host.hooks = u.hooks
 		host.InitDOH(u)
 	}
 
@@ -288,8 +317,7 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		log.Infof("%v: %v", dir, n)
 	case "health_check":
 		args := c.RemainingArgs()
-		n := len(args)
-		if n != 1 && n != 2 {
+		if len(args) == 0 {
 			return c.ArgErr()
 		}
 		dur, err := parseDuration0(dir, args[0])
@@ -299,12 +327,14 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		if dur < minHcInterval && dur != 0 {
 			return c.Errf("%v: minimal interval is %v", dir, minHcInterval)
 		}
-		if n == 2 && args[1] != "no_rec" {
-			return c.Errf("%v: unknown option: %v", dir, args[1])
-		}
 		u.checkInterval = dur
-		u.transport.recursionDesired = n == 1
-		log.Infof("%v: %v %v", dir, u.checkInterval, u.transport.recursionDesired)
+		u.transport.recursionDesired = true
+		u.probe = newHcProbe()
+		if err := parseHcOptions(c, args[1:], u.HealthCheck); err != nil {
+			return err
+		}
+		log.Infof("%v: %v %v probe: %v timeout: %v tcp: %v jitter: %v max_backoff: %v",
+			dir, u.checkInterval, u.transport.recursionDesired, u.probe, u.timeout, u.probeTcp, u.checkJitter, u.maxBackoff)
 	case "to":
 		// Multiple "to"s will be merged together
 		if err := parseTo(c, u); err != nil {
@@ -359,6 +389,29 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 				return err
 			}
 		}
+	case "canary":
+		if err := parseCanary(c, u); err != nil {
+			return err
+		}
+	case "outlier_detection":
+		od, err := parseOutlierDetection(c)
+		if err != nil {
+			return err
+		}
+		u.outlier = od
+		log.Infof("%v: %v", dir, od)
+	case "state_notify", "state_webhook":
+		if err := parseStateHooks(c, u); err != nil {
+			return err
+		}
+	case "client_source":
+		if err := parseClientSource(c, u); err != nil {
+			return err
+		}
+	case "admin_listen":
+		if err := parseAdminListen(c, u); err != nil {
+			return err
+		}
 	case "no_ipv6":
 		args := c.RemainingArgs()
 		if len(args) != 0 {
@@ -366,6 +419,19 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		}
 		u.noIPv6 = true
 		log.Infof("%v: %v", dir, u.noIPv6)
+	case "bogus_nxdomain":
+		if err := parseBogusNxdomain(c, u); err != nil {
+			return err
+		}
+	case "dual":
+		if err := parseDual(c, u); err != nil {
+			return err
+		}
+	case "min_ttl", "max_ttl", "negative_ttl":
+		if err := u.ttl.parse(dir, c.RemainingArgs()); err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		log.Infof("%v: %v", dir, u.ttl)
 	case "debug":
 		u.debug = true
 	default:
@@ -387,6 +453,20 @@ func parseSubBlock(c *caddy.Controller, u *reloadableUpstream) error {
 			}
 			mch.name = args[0]
 			log.Infof("name %s", mch.name)
+		case "mode":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			switch args[0] {
+			case matchModeAny:
+				mch.matchAll = false
+			case matchModeAll:
+				mch.matchAll = true
+			default:
+				return c.Errf("%v: unknown mode %q, expected %v or %v", dir, args[0], matchModeAny, matchModeAll)
+			}
+			log.Infof("mode %s", args[0])
 		case "to":
 			args := c.RemainingArgs()
 			if len(args) != 1 {
@@ -399,29 +479,138 @@ func parseSubBlock(c *caddy.Controller, u *reloadableUpstream) error {
 			if len(args) < 0 {
 				return c.ArgErr()
 			}
-			mch.clientIps = stringset.NewFromSlice(args)
-			log.Infof("client_ips %s", mch.clientIps.String())
+			pos, neg, err := splitNegated(args)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			mch.clientIps = stringset.NewFromSlice(pos)
+			mch.nonClientIps = stringset.NewFromSlice(neg)
+			log.Infof("client_ips %s !%s", mch.clientIps.String(), mch.nonClientIps.String())
 		case "anwser_ips":
 			args := c.RemainingArgs()
 			if len(args) < 0 {
 				return c.ArgErr()
 			}
-			mch.anwserIps = stringset.NewFromSlice(args)
-			log.Infof("anwser_ips %s", mch.anwserIps.String())
+			pos, neg, err := splitNegated(args)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			mch.anwserIps = stringset.NewFromSlice(pos)
+			mch.nonAnwserIps = stringset.NewFromSlice(neg)
+			log.Infof("anwser_ips %s !%s", mch.anwserIps.String(), mch.nonAnwserIps.String())
 		case "query_names":
 			args := c.RemainingArgs()
 			if len(args) < 0 {
 				return c.ArgErr()
 			}
-			mch.queryNames = stringset.NewFromSlice(args)
-			log.Infof("query_names %s", mch.queryNames.String())
+			pos, neg, err := splitNegated(args)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			tags, patterns, err := parseNamePatterns(pos)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			nonTags, nonPatterns, err := parseNamePatterns(neg)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			mch.queryNames, mch.queryNamePatterns = stringset.NewFromSlice(tags), patterns
+			mch.nonQueryNames, mch.nonQueryNamePatterns = stringset.NewFromSlice(nonTags), nonPatterns
+			log.Infof("query_names %s", joinNonEmpty(mch.queryNames.String(), patterns.String(), negatedString(mch.nonQueryNames, nonPatterns)))
+		case "qtypes":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			for _, arg := range args {
+				types := mch.qtypes
+				if strings.HasPrefix(arg, "!") {
+					types, arg = mch.nonQtypes, arg[1:]
+				}
+				t, ok := dns.StringToType[strings.ToUpper(arg)]
+				if !ok {
+					return c.Errf("%v: unknown query type %q", dir, arg)
+				}
+				types[t] = struct{}{}
+			}
+			log.Infof("qtypes %s", mch.qtypesString())
+		case "servers", "transports":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			pos, neg, err := splitNegated(args)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			set, nonSet := mch.servers, mch.nonServers
+			if dir == "transports" {
+				set, nonSet = mch.transports, mch.nonTransports
+				for _, t := range append(pos, neg...) {
+					if !isTransport(t) {
+						return c.Errf("%v: unknown transport %q", dir, t)
+					}
+				}
+			}
+			for _, v := range pos {
+				set[v] = struct{}{}
+			}
+			for _, v := range neg {
+				nonSet[v] = struct{}{}
+			}
+			log.Infof("%v %s", dir, mch.servingString())
+		case "listen":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			pos, neg, err := splitNegated(args)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			for _, arg := range pos {
+				l, err := parseListenAddr(arg)
+				if err != nil {
+					return c.Errf("%v: %v", dir, err)
+				}
+				mch.listens = append(mch.listens, l)
+			}
+			for _, arg := range neg {
+				l, err := parseListenAddr(arg)
+				if err != nil {
+					return c.Errf("%v: %v", dir, err)
+				}
+				mch.nonListens = append(mch.nonListens, l)
+			}
+			log.Infof("listen %s", mch.servingString())
+		case "schedule":
+			sc, err := parseSchedule(c.RemainingArgs())
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			mch.schedules = append(mch.schedules, sc)
+			log.Infof("schedule %s", sc)
 		case "anwser_cnames":
 			args := c.RemainingArgs()
 			if len(args) < 0 {
 				return c.ArgErr()
 			}
-			mch.anwserCNames = stringset.NewFromSlice(args)
-			log.Infof("anwser_cnames %s", mch.anwserCNames.String())
+			pos, neg, err := splitNegated(args)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			tags, patterns, err := parseNamePatterns(pos)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			nonTags, nonPatterns, err := parseNamePatterns(neg)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			mch.anwserCNames, mch.anwserCNamePatterns = stringset.NewFromSlice(tags), patterns
+			mch.nonAnwserCNames, mch.nonAnwserCNamePatterns = stringset.NewFromSlice(nonTags), nonPatterns
+			log.Infof("anwser_cnames %s", joinNonEmpty(mch.anwserCNames.String(), patterns.String(), negatedString(mch.nonAnwserCNames, nonPatterns)))
 		case "notify":
 			args := c.RemainingArgs()
 			if len(args) < 1 {
@@ -445,10 +634,66 @@ func parseSubBlock(c *caddy.Controller, u *reloadableUpstream) error {
 			}
 			log.Infof("force_ecs %s", mch.forceEcs)
 		case "nxdomain":
-			mch.nxdomain = true
+			// Shorthand for block nxdomain
+			mch.block.mode = blockModeNxdomain
 			log.Info("nxdomain")
+		case "block":
+			if err := mch.block.parseMode(c.RemainingArgs()); err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			log.Infof("block %s", mch.block.mode)
+		case "ede":
+			if err := mch.block.parseEde(c.RemainingArgs()); err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			log.Infof("ede %s", mch.block)
+		case "answer":
+			if err := mch.answer.parse(c.RemainingArgs()); err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			log.Infof("answer %s", mch.answer)
+		case "answer_ttl":
+			if err := mch.answer.parseTtl(c.RemainingArgs()); err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			log.Infof("answer_ttl %d", mch.answer.ttl)
+		case "min_ttl", "max_ttl", "negative_ttl":
+			if err := mch.ttl.parse(dir, c.RemainingArgs()); err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			log.Infof("%v %v", dir, mch.ttl)
+		case "strip":
+			if err := mch.strip.parse(c.RemainingArgs()); err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			log.Infof("strip %v", mch.strip)
+		case "aaaa_nodata":
+			if len(c.RemainingArgs()) != 0 {
+				return c.ArgErr()
+			}
+			mch.aaaaNodata = true
+			log.Info("aaaa_nodata")
+		case "drop_records":
+			if len(c.RemainingArgs()) != 0 {
+				return c.ArgErr()
+			}
+			mch.dropRecords = true
+			log.Info("drop_records")
+		case "reroute":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			mch.reroute = args[0]
+			log.Infof("reroute %s", mch.reroute)
 		}
 	}
+	if mch.dropRecords && !mch.hasAnwserIps() {
+		return c.Err("drop_records: anwser_ips is required")
+	}
+	if mch.reroute != "" && !mch.hasAnwserConds() {
+		return c.Err("reroute: anwser_ips or anwser_cnames is required")
+	}
 	if mch.isValid {
 		u.subMatchers.addSubMatcher(mch)
 		log.Info("<< add new sub matcher ")
@@ -456,6 +701,91 @@ func parseSubBlock(c *caddy.Controller, u *reloadableUpstream) error {
 	return nil
 }
 
+// Parses health_check options after the interval:
+//	no_rec | probe <name> <type> | rcode <rcode> | answer | answer_net <tag> | jitter <fraction> | max_backoff <duration>
+//	timeout <duration> | tcp
+func parseHcOptions(c *caddy.Controller, args []string, hc *HealthCheck) error {
+	dir := c.Val()
+	probe := hc.probe
+	for i := 0; i < len(args); i++ {
+		switch opt := args[i]; opt {
+		case "no_rec":
+			hc.transport.recursionDesired = false
+		case "probe":
+			if i+2 >= len(args) {
+				return c.Errf("%v: %v expects a name and a type", dir, opt)
+			}
+			name, qtype := args[i+1], strings.ToUpper(args[i+2])
+			if _, ok := dns.IsDomainName(name); !ok {
+				return c.Errf("%v: %q isn't a valid domain name", dir, name)
+			}
+			t, ok := dns.StringToType[qtype]
+			if !ok {
+				return c.Errf("%v: unknown query type %q", dir, qtype)
+			}
+			probe.name = dns.Fqdn(strings.ToLower(name))
+			probe.qtype = t
+			i += 2
+		case "rcode":
+			if i+1 >= len(args) {
+				return c.Errf("%v: %v expects an rcode", dir, opt)
+			}
+			rcode, ok := dns.StringToRcode[strings.ToUpper(args[i+1])]
+			if !ok {
+				return c.Errf("%v: unknown rcode %q", dir, args[i+1])
+			}
+			probe.rcode = rcode
+			i++
+		case "answer":
+			probe.requireAnswer = true
+		case "answer_net":
+			if i+1 >= len(args) {
+				return c.Errf("%v: %v expects a netlist tag", dir, opt)
+			}
+			probe.answerNet = args[i+1]
+			i++
+		case "jitter":
+			if i+1 >= len(args) {
+				return c.Errf("%v: %v expects a fraction", dir, opt)
+			}
+			jitter, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || jitter < 0 || jitter >= 1 {
+				return c.Errf("%v: %v %q out of range [0, 1)", dir, opt, args[i+1])
+			}
+			hc.checkJitter = jitter
+			i++
+		case "max_backoff":
+			if i+1 >= len(args) {
+				return c.Errf("%v: %v expects a duration", dir, opt)
+			}
+			dur, err := parseDuration0(dir, args[i+1])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			hc.maxBackoff = dur
+			i++
+		case "timeout":
+			if i+1 >= len(args) {
+				return c.Errf("%v: %v expects a duration", dir, opt)
+			}
+			dur, err := parseDuration0(dir, args[i+1])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			if dur == 0 {
+				return c.Errf("%v: %v must be positive", dir, opt)
+			}
+			hc.timeout = dur
+			i++
+		case "tcp":
+			hc.probeTcp = true
+		default:
+			return c.Errf("%v: unknown option: %v", dir, opt)
+		}
+	}
+	return nil
+}
+
 // Return a non-negative int32
 // see: https://golang.org/pkg/builtin/#int
 func parseInt32(c *caddy.Controller) (int32, error) {
@@ -543,8 +873,10 @@ const (
 	defaultUrlReloadInterval  = 30 * time.Minute
 	defaultUrlReadTimeout     = 15 * time.Second
 
-	defaultHcInterval = 2000 * time.Millisecond
-	defaultHcTimeout  = 5000 * time.Millisecond
+	defaultHcInterval   = 2000 * time.Millisecond
+	defaultHcTimeout    = 5000 * time.Millisecond
+	defaultHcJitter     = 0.1
+	defaultHcMaxBackoff = 2 * time.Minute
 )
 
 const (
@@ -230,6 +230,26 @@ func hostPortIsIpPort(hostport string) bool {
 	return i > 0 && net.ParseIP(host[:i]) != nil
 }
 
+// Return the single-host network of ip, i.e. 1.2.3.4/32
+func hostIPNet(ip net.IP) *net.IPNet {
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// Remove all records but EDNS0 OPT from the additional section of m
+func keepOnlyOpt(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
 func newEDNS0Subnet(ip net.IP, mask uint8, v6 bool) *dns.EDNS0_SUBNET {
 	edns0Subnet := new(dns.EDNS0_SUBNET)
 	// edns family: https://www.iana.org/assignments/address-family-numbers/address-family-numbers.xhtml
@@ -1,9 +1,37 @@
 package metadnsq
 
 import (
+	"net"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
+func TestHostIPNet(t *testing.T) {
+	for input, expected := range map[string]string{
+		"1.2.3.4":         "1.2.3.4/32",
+		"::ffff:1.2.3.4":  "1.2.3.4/32",
+		"2001:db8::1":     "2001:db8::1/128",
+		"fe80::1:2:3:4:5": "fe80::1:2:3:4:5/128",
+	} {
+		if n := hostIPNet(net.ParseIP(input)); n.String() != expected {
+			t.Errorf("%v: expected %v, got %v", input, expected, n)
+		}
+	}
+}
+
+func TestKeepOnlyOpt(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("ns.example.com. 60 IN A 1.2.3.4")
+	m.Extra = append(m.Extra, rr)
+	m.SetEdns0(1232, false)
+	keepOnlyOpt(m)
+	if len(m.Extra) != 1 || m.IsEdns0() == nil {
+		t.Errorf("Expected only OPT kept, got %v", m.Extra)
+	}
+}
+
 func TestStringToDomain(t *testing.T) {
 	tests := []struct {
 		input          string